@@ -0,0 +1,96 @@
+package ci
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/serviceaccount"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Ways the pipelines authenticate to Google Cloud
+const (
+	// The pipeline principals are granted the roles and use the federated token directly
+	AuthModeDirect = "direct"
+	// The pipeline principals impersonate a service account holding the roles
+	AuthModeServiceAccount = "service-account"
+	// Both, e.g. while migrating workflows from one mode to the other
+	AuthModeBoth = "both"
+)
+
+// lookupAuthMode normalizes an auth mode. Empty defaults to direct, or both when CREATE_SERVICE_ACCOUNT
+// is set, which created the service account next to the direct grants.
+func lookupAuthMode(mode string, createServiceAccount bool) (string, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		if createServiceAccount {
+			return AuthModeBoth, nil
+		}
+
+		return AuthModeDirect, nil
+	case AuthModeDirect:
+		if createServiceAccount {
+			return "", fmt.Errorf("CREATE_SERVICE_ACCOUNT requires the %s or %s mode", AuthModeServiceAccount, AuthModeBoth)
+		}
+
+		return AuthModeDirect, nil
+	case AuthModeServiceAccount:
+		return AuthModeServiceAccount, nil
+	case AuthModeBoth:
+		return AuthModeBoth, nil
+	default:
+		return "", fmt.Errorf("unknown auth mode %q, must be one of: %s, %s, %s", mode, AuthModeDirect, AuthModeServiceAccount, AuthModeBoth)
+	}
+}
+
+// validateAuthMode normalizes the auth mode and checks it against the other settings
+func validateAuthMode(config *Config) error {
+	mode, err := lookupAuthMode(config.AuthMode, config.CreateServiceAccount)
+	if err != nil {
+		return err
+	}
+
+	config.AuthMode = mode
+
+	// A single service account can't hold different roles for each trust profile
+	if config.usesServiceAccount() && len(config.TrustProfiles) > 0 {
+		return fmt.Errorf("TRUST_PROFILES can't be combined with the %s auth mode", config.AuthMode)
+	}
+
+	// Only the workflows allowed to push can impersonate the service account, the others would lose their read access
+	if config.AuthMode == AuthModeServiceAccount && writeAccessGated(config) {
+		return fmt.Errorf("ALLOWED_REFS, ALLOWED_REF_TYPES, ALLOWED_REUSABLE_WORKFLOWS and ALLOWED_ENVIRONMENTS require the %s or %s auth mode, "+
+			"so the workflows that can't push keep read access", AuthModeDirect, AuthModeBoth)
+	}
+
+	// The service account can't tell the promotion workflow apart, it would need a direct binding
+	if config.AuthMode == AuthModeServiceAccount && len(config.EnvironmentTiers) > 0 {
+		return fmt.Errorf("ENVIRONMENT_TIERS require the %s or %s auth mode, so the promotion workflow can be granted the upper tiers",
+			AuthModeDirect, AuthModeBoth)
+	}
+
+	return nil
+}
+
+// usesServiceAccount reports whether the pipelines can impersonate a service account
+func (c *Config) usesServiceAccount() bool {
+	return c.AuthMode == AuthModeServiceAccount || c.AuthMode == AuthModeBoth
+}
+
+// grantsDirectAccess reports whether the pipeline principals are granted the roles themselves
+func (c *Config) grantsDirectAccess() bool {
+	return c.AuthMode != AuthModeServiceAccount
+}
+
+// newServiceAccountPrincipal returns the service account as a principal, so it gets the same
+// pipeline roles as the repositories. Its bindings are suffixed with service-account.
+func newServiceAccountPrincipal(account *serviceaccount.Account) pipelinePrincipal {
+	member := pulumi.Sprintf("serviceAccount:%s", account.Email)
+
+	return pipelinePrincipal{
+		repository: AuthModeServiceAccount,
+		id:         member,
+		writeID:    member,
+		key:        AuthModeServiceAccount,
+	}
+}
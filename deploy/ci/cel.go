@@ -0,0 +1,198 @@
+package ci
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/parser"
+)
+
+// maxAttributeConditionLength is the longest attribute condition a workload identity pool provider accepts
+const maxAttributeConditionLength = 4096
+
+// celKind tells how an expression binds when combined with others
+type celKind int
+
+const (
+	// Method calls and macros, e.g. attribute.repository.matches("...")
+	celCallKind celKind = iota
+	// Comparisons, e.g. attribute.repository == "my-org/my-repo"
+	celComparisonKind
+	celAndKind
+	celOrKind
+	celNotKind
+)
+
+// celExpr is a boolean CEL expression on the token attributes or claims. Values are always rendered as
+// escaped string literals, so no configuration value can change the structure of the expression.
+// The zero value is no expression, and is skipped when combined with others.
+type celExpr struct {
+	text string
+	kind celKind
+}
+
+// String returns the expression text
+func (e celExpr) String() string {
+	return e.text
+}
+
+func (e celExpr) empty() bool {
+	return e.text == ""
+}
+
+// celString returns a CEL string literal for a value. CEL shares the Go escape sequences.
+func celString(value string) string {
+	return strconv.Quote(value)
+}
+
+// celEquals matches a field, e.g. attribute.repository, against a value
+func celEquals(field, value string) celExpr {
+	return celExpr{text: fmt.Sprintf("%s == %s", field, celString(value)), kind: celComparisonKind}
+}
+
+// celNotEquals excludes a value of a field
+func celNotEquals(field, value string) celExpr {
+	return celExpr{text: fmt.Sprintf("%s != %s", field, celString(value)), kind: celComparisonKind}
+}
+
+// celIn matches a field against a list of values
+func celIn(field string, values []string) celExpr {
+	literals := make([]string, 0, len(values))
+	for _, value := range values {
+		literals = append(literals, celString(value))
+	}
+
+	return celExpr{text: fmt.Sprintf("%s in [%s]", field, strings.Join(literals, ", ")), kind: celComparisonKind}
+}
+
+// celAnyOf matches a field against one or more values, with an equality when there is only one
+func celAnyOf(field string, values []string) celExpr {
+	if len(values) == 1 {
+		return celEquals(field, values[0])
+	}
+
+	return celIn(field, values)
+}
+
+// celStartsWith matches a field starting with a prefix
+func celStartsWith(field, prefix string) celExpr {
+	return celExpr{text: fmt.Sprintf("%s.startsWith(%s)", field, celString(prefix)), kind: celCallKind}
+}
+
+// celMatches matches a field against an RE2 regular expression
+func celMatches(field, expression string) celExpr {
+	return celExpr{text: fmt.Sprintf("%s.matches(%s)", field, celString(expression)), kind: celCallKind}
+}
+
+// celHas tests whether a claim is present, e.g. assertion.environment
+func celHas(field string) celExpr {
+	return celExpr{text: fmt.Sprintf("has(%s)", field), kind: celCallKind}
+}
+
+// celBefore compares a timestamp field, e.g. request.time, with an RFC 3339 timestamp
+func celBefore(field, timestamp string) celExpr {
+	return celExpr{text: fmt.Sprintf("%s < timestamp(%s)", field, celString(timestamp)), kind: celComparisonKind}
+}
+
+// celAnd requires every non-empty term
+func celAnd(terms ...celExpr) celExpr {
+	return celJoin(celAndKind, " && ", terms)
+}
+
+// celOr requires any non-empty term
+func celOr(terms ...celExpr) celExpr {
+	return celJoin(celOrKind, " || ", terms)
+}
+
+// celNot negates an expression
+func celNot(term celExpr) celExpr {
+	if term.empty() {
+		return term
+	}
+
+	// Negation binds tighter than comparisons, !a == "b" would compare the negated field
+	if term.kind == celCallKind {
+		return celExpr{text: "!" + term.text, kind: celNotKind}
+	}
+
+	return celExpr{text: fmt.Sprintf("!(%s)", term.text), kind: celNotKind}
+}
+
+func celJoin(kind celKind, operator string, terms []celExpr) celExpr {
+	texts := make([]string, 0, len(terms))
+
+	var last celExpr
+
+	for _, term := range terms {
+		if term.empty() {
+			continue
+		}
+
+		last = term
+
+		// Nested conjunctions and disjunctions are kept in parentheses for readability
+		if term.kind == celAndKind || term.kind == celOrKind {
+			texts = append(texts, fmt.Sprintf("(%s)", term.text))
+		} else {
+			texts = append(texts, term.text)
+		}
+	}
+
+	switch len(texts) {
+	case 0:
+		return celExpr{}
+	case 1:
+		return last
+	default:
+		return celExpr{text: strings.Join(texts, operator), kind: kind}
+	}
+}
+
+// validateCELSyntax parses an expression, returning the syntax errors if any
+func validateCELSyntax(expression string) (*ast.AST, error) {
+	celParser, err := parser.NewParser(parser.Macros(parser.AllMacros...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL parser: %w", err)
+	}
+
+	parsed, errs := celParser.Parse(common.NewTextSource(expression))
+	if errs != nil && len(errs.GetErrors()) > 0 {
+		return nil, fmt.Errorf("invalid CEL expression %q: %s", expression, errs.ToDisplayString())
+	}
+
+	return parsed, nil
+}
+
+// validateAttributeCondition checks that a provider condition is valid CEL within the length limit, and that it
+// actually restricts the tokens. A condition that reads no attribute or claim would trust every token of the issuer.
+func validateAttributeCondition(condition celExpr) error {
+	if condition.empty() {
+		return fmt.Errorf("attribute condition can't be empty, every token of the issuer would be trusted")
+	}
+
+	if len(condition.text) > maxAttributeConditionLength {
+		return fmt.Errorf("attribute condition is %d characters long, at most %d are allowed", len(condition.text), maxAttributeConditionLength)
+	}
+
+	parsed, err := validateCELSyntax(condition.text)
+	if err != nil {
+		return err
+	}
+
+	restricted := false
+
+	ast.PostOrderVisit(parsed.Expr(), ast.NewExprVisitor(func(expr ast.Expr) {
+		if expr.Kind() == ast.IdentKind && (expr.AsIdent() == "attribute" || expr.AsIdent() == "assertion") {
+			restricted = true
+		}
+	}))
+
+	if !restricted {
+		return fmt.Errorf("attribute condition %q doesn't depend on the token, it must restrict the trusted pipelines", condition.text)
+	}
+
+	return nil
+}
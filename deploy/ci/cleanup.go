@@ -0,0 +1,207 @@
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Cleanup policy actions and tag states accepted by Artifact Registry
+const (
+	CleanupActionKeep   = "KEEP"
+	CleanupActionDelete = "DELETE"
+
+	TagStateAny      = "ANY"
+	TagStateTagged   = "TAGGED"
+	TagStateUntagged = "UNTAGGED"
+)
+
+// maxCleanupPolicies is the number of cleanup policies Artifact Registry allows per repository
+const maxCleanupPolicies = 10
+
+var (
+	cleanupPolicyIDPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,62}$`)
+	// Ages are given in seconds, minutes, hours or days, e.g. 30d
+	cleanupAgePattern = regexp.MustCompile(`^[0-9]+[smhd]$`)
+)
+
+// CleanupPolicySpec describes an Artifact Registry cleanup policy. A policy either keeps the most recent
+// versions of each matching package (keepCount) or matches versions by condition.
+type CleanupPolicySpec struct {
+	ID string `json:"id"`
+	// KEEP or DELETE
+	Action string `json:"action"`
+	// ANY, TAGGED or UNTAGGED. Defaults to TAGGED with tag prefixes and ANY otherwise.
+	TagState            string   `json:"tagState,omitempty"`
+	TagPrefixes         []string `json:"tagPrefixes,omitempty"`
+	PackageNamePrefixes []string `json:"packageNamePrefixes,omitempty"`
+	VersionNamePrefixes []string `json:"versionNamePrefixes,omitempty"`
+	// Match versions older or newer than a duration (e.g. 30d)
+	OlderThan string `json:"olderThan,omitempty"`
+	NewerThan string `json:"newerThan,omitempty"`
+	// Keep the most recent versions of each matching package. KEEP only, combines with packageNamePrefixes.
+	KeepCount int `json:"keepCount,omitempty"`
+}
+
+// CleanupPolicySpecs is a list of cleanup policies, decoded from a JSON array when loaded from the environment
+type CleanupPolicySpecs []CleanupPolicySpec
+
+// Decode implements envconfig.Decoder
+func (s *CleanupPolicySpecs) Decode(value string) error {
+	return json.Unmarshal([]byte(value), (*[]CleanupPolicySpec)(s))
+}
+
+// normalizeCleanupPolicies validates the policies and returns a copy with the actions and tag states
+// upper-cased and defaulted. A nil list stays nil so the default policies apply.
+func normalizeCleanupPolicies(specs CleanupPolicySpecs) (CleanupPolicySpecs, error) {
+	if specs == nil {
+		return nil, nil
+	}
+
+	if len(specs) > maxCleanupPolicies {
+		return nil, fmt.Errorf("at most %d cleanup policies are allowed per repository, got %d", maxCleanupPolicies, len(specs))
+	}
+
+	normalized := make(CleanupPolicySpecs, 0, len(specs))
+	seen := map[string]bool{}
+
+	for _, spec := range specs {
+		if !cleanupPolicyIDPattern.MatchString(spec.ID) {
+			return nil, fmt.Errorf("cleanup policy id %q must start with a letter and contain only lowercase letters, digits and hyphens", spec.ID)
+		}
+
+		if seen[spec.ID] {
+			return nil, fmt.Errorf("cleanup policy %q is configured more than once", spec.ID)
+		}
+
+		seen[spec.ID] = true
+
+		spec.Action = strings.ToUpper(spec.Action)
+		spec.TagState = strings.ToUpper(spec.TagState)
+
+		err := validateCleanupPolicy(&spec)
+		if err != nil {
+			return nil, fmt.Errorf("cleanup policy %q: %w", spec.ID, err)
+		}
+
+		normalized = append(normalized, spec)
+	}
+
+	return normalized, nil
+}
+
+func validateCleanupPolicy(spec *CleanupPolicySpec) error {
+	if spec.Action != CleanupActionKeep && spec.Action != CleanupActionDelete {
+		return fmt.Errorf("unknown action %q, must be one of: %s, %s", spec.Action, CleanupActionKeep, CleanupActionDelete)
+	}
+
+	for _, prefixes := range [][]string{spec.TagPrefixes, spec.PackageNamePrefixes, spec.VersionNamePrefixes} {
+		for _, prefix := range prefixes {
+			if strings.TrimSpace(prefix) == "" {
+				return fmt.Errorf("prefixes can't be empty")
+			}
+		}
+	}
+
+	if spec.KeepCount != 0 {
+		if spec.Action != CleanupActionKeep {
+			return fmt.Errorf("keepCount is only supported by %s policies", CleanupActionKeep)
+		}
+
+		if spec.KeepCount < 0 {
+			return fmt.Errorf("keepCount must be positive, got %d", spec.KeepCount)
+		}
+
+		// Artifact Registry policies have either a condition or a most recent versions rule
+		if spec.TagState != "" || len(spec.TagPrefixes) > 0 || len(spec.VersionNamePrefixes) > 0 || spec.OlderThan != "" || spec.NewerThan != "" {
+			return fmt.Errorf("keepCount can only be combined with packageNamePrefixes")
+		}
+
+		return nil
+	}
+
+	switch spec.TagState {
+	case "":
+		spec.TagState = TagStateAny
+		if len(spec.TagPrefixes) > 0 {
+			spec.TagState = TagStateTagged
+		}
+	case TagStateAny, TagStateTagged, TagStateUntagged:
+	default:
+		return fmt.Errorf("unknown tag state %q, must be one of: %s, %s, %s", spec.TagState, TagStateAny, TagStateTagged, TagStateUntagged)
+	}
+
+	if len(spec.TagPrefixes) > 0 && spec.TagState != TagStateTagged {
+		return fmt.Errorf("tagPrefixes require the %s tag state, got %s", TagStateTagged, spec.TagState)
+	}
+
+	for _, age := range []string{spec.OlderThan, spec.NewerThan} {
+		if age != "" && !cleanupAgePattern.MatchString(age) {
+			return fmt.Errorf("age %q must be a number of seconds, minutes, hours or days (e.g. 30d)", age)
+		}
+	}
+
+	// A delete policy without any condition would wipe the repository
+	if spec.Action == CleanupActionDelete && spec.TagState == TagStateAny && len(spec.PackageNamePrefixes) == 0 &&
+		len(spec.VersionNamePrefixes) == 0 && spec.OlderThan == "" && spec.NewerThan == "" {
+		return fmt.Errorf("%s policies must match on a tag state, a prefix or an age", CleanupActionDelete)
+	}
+
+	return nil
+}
+
+// validateImmutableCleanupPolicies rejects delete policies that can match tagged versions. With immutable
+// tags, tagged versions are releases and are never garbage collected.
+func validateImmutableCleanupPolicies(specs CleanupPolicySpecs) error {
+	for _, spec := range specs {
+		if spec.Action == CleanupActionDelete && spec.TagState != TagStateUntagged {
+			return fmt.Errorf("cleanup policy %q: %s policies must match %s versions with immutable tags, got %s", spec.ID, CleanupActionDelete, TagStateUntagged, spec.TagState)
+		}
+	}
+
+	return nil
+}
+
+// newCustomCleanupPolicies converts validated cleanup policy specs into repository cleanup policies
+func newCustomCleanupPolicies(specs CleanupPolicySpecs) artifactregistry.RepositoryCleanupPolicyArray {
+	policies := make(artifactregistry.RepositoryCleanupPolicyArray, 0, len(specs))
+
+	for _, spec := range specs {
+		policy := &artifactregistry.RepositoryCleanupPolicyArgs{
+			Id:     pulumi.String(spec.ID),
+			Action: pulumi.String(spec.Action),
+		}
+
+		if spec.KeepCount > 0 {
+			policy.MostRecentVersions = &artifactregistry.RepositoryCleanupPolicyMostRecentVersionsArgs{
+				KeepCount:           pulumi.Int(spec.KeepCount),
+				PackageNamePrefixes: pulumi.ToStringArray(spec.PackageNamePrefixes),
+			}
+		} else {
+			condition := &artifactregistry.RepositoryCleanupPolicyConditionArgs{
+				TagState:            pulumi.String(spec.TagState),
+				TagPrefixes:         pulumi.ToStringArray(spec.TagPrefixes),
+				PackageNamePrefixes: pulumi.ToStringArray(spec.PackageNamePrefixes),
+				VersionNamePrefixes: pulumi.ToStringArray(spec.VersionNamePrefixes),
+			}
+
+			if spec.OlderThan != "" {
+				condition.OlderThan = pulumi.String(spec.OlderThan)
+			}
+
+			if spec.NewerThan != "" {
+				condition.NewerThan = pulumi.String(spec.NewerThan)
+			}
+
+			policy.Condition = condition
+		}
+
+		policies = append(policies, policy)
+	}
+
+	return policies
+}
@@ -0,0 +1,112 @@
+package ci
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// maxConditionTitleLength is the length IAM allows for condition titles
+const maxConditionTitleLength = 100
+
+// sbomBucketName returns the name of the SBOM bucket, named after its project like the default destination of
+// gcloud artifacts sbom load. Images of another project must pass it as --destination.
+func sbomBucketName(config *Config) string {
+	return fmt.Sprintf("artifacts-%s-sbom", config.sbomBucketProject())
+}
+
+// validateProjectIAMConditions checks the expiry of the project-level bindings
+func validateProjectIAMConditions(config *Config) error {
+	if config.ProjectIAMExpiry != "" {
+		_, err := time.Parse(time.RFC3339, config.ProjectIAMExpiry)
+		if err != nil {
+			return fmt.Errorf("PROJECT_IAM_EXPIRY must be an RFC 3339 timestamp (e.g. 2026-12-31T00:00:00Z): %w", err)
+		}
+	}
+
+	for _, role := range append(predefinedProjectRoles(legacySBOMRoles, ""), projectRole{key: sbomCustomRoleKey}) {
+		condition := projectIAMCondition(config, role.key)
+		if condition.empty() {
+			continue
+		}
+
+		_, err := validateCELSyntax(condition.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// projectIAMScope returns the resources a project role of the pipeline is limited to. Only Cloud Storage
+// buckets can be scoped: Container Analysis doesn't provide resource attributes to IAM conditions, so the
+// notes and occurrences roles, and the roles the component doesn't know, like those of trust profiles, have no scope.
+// See: https://cloud.google.com/iam/docs/conditions-resource-attributes
+func projectIAMScope(config *Config, roleKey string) celExpr {
+	const bucketType = "storage.googleapis.com/Bucket"
+
+	bucketName := fmt.Sprintf("projects/_/buckets/%s", sbomBucketName(config))
+
+	switch roleKey {
+	case sbomBucketViewerRole:
+		return celAnd(celEquals("resource.type", bucketType), celEquals("resource.name", bucketName))
+	case sbomCustomRoleKey:
+		// Container Analysis requests have no resource type and are left unscoped
+		return celOr(celNotEquals("resource.type", bucketType), celEquals("resource.name", bucketName))
+	default:
+		return celExpr{}
+	}
+}
+
+// projectIAMCondition returns the IAM condition of a project role of the pipeline: its scope with
+// SCOPE_PROJECT_IAM, and the expiry with PROJECT_IAM_EXPIRY. Empty when neither applies.
+func projectIAMCondition(config *Config, roleKey string) celExpr {
+	var scope, expiry celExpr
+
+	if config.ScopeProjectIAM {
+		scope = projectIAMScope(config, roleKey)
+	}
+
+	if config.ProjectIAMExpiry != "" {
+		expiry = celBefore("request.time", config.ProjectIAMExpiry)
+	}
+
+	return celAnd(scope, expiry)
+}
+
+// newProjectIAMCondition returns the condition args of a project binding, nil when it's unconditional
+func newProjectIAMCondition(config *Config, roleKey string) *projects.IAMMemberConditionArgs {
+	condition := projectIAMCondition(config, roleKey)
+	if condition.empty() {
+		return nil
+	}
+
+	scoped := config.ScopeProjectIAM && !projectIAMScope(config, roleKey).empty()
+
+	var kind, description string
+
+	switch {
+	case scoped && config.ProjectIAMExpiry != "":
+		kind = "scope"
+		description = fmt.Sprintf("Limits the pipeline role to the SBOM bucket until %s", config.ProjectIAMExpiry)
+	case scoped:
+		kind = "scope"
+		description = "Limits the pipeline role to the SBOM bucket"
+	default:
+		kind = "expiry"
+		description = fmt.Sprintf("Grants the pipeline role until %s", config.ProjectIAMExpiry)
+	}
+
+	// Titles tell the bindings apart in the console and the audit logs, e.g. ci-pipeline-scope-storage.bucketViewer
+	title := fmt.Sprintf("%s-pipeline-%s-%s", config.ResourcePrefix, kind, strings.TrimPrefix(roleKey, "roles/"))
+
+	return &projects.IAMMemberConditionArgs{
+		Title:       pulumi.String(capToMax(title, maxConditionTitleLength)),
+		Description: pulumi.String(description),
+		Expression:  pulumi.String(condition.String()),
+	}
+}
@@ -11,28 +11,131 @@ import (
 // Config holds all the configuration from environment variables
 type Config struct {
 	GCPProject string `envconfig:"GCP_PROJECT" required:"true"`
+	// Project of the workload identity pool and its providers, GCP_PROJECT by default
+	IdentityProject string `envconfig:"IDENTITY_PROJECT" default:""`
+	// Project of the repositories, the service account and the pipeline project roles, GCP_PROJECT by default
+	RegistryProject string `envconfig:"REGISTRY_PROJECT" default:""`
+	// Project of the SBOM bucket, the registry project by default
+	SBOMBucketProject string `envconfig:"SBOM_BUCKET_PROJECT" default:""`
 	// Supports both single region (e.g. us-central1, us-east1, etc.) and multi-region (e.g. us, europe, asia)
 	GCPRegion string `envconfig:"GCP_REGION" required:"true"`
 	// Repository location for Artifact Registry. Defaults to GCP_REGION but can be overridden for multi-region (e.g. us, europe, asia)
 	RepositoryLocation string `envconfig:"REPOSITORY_LOCATION" default:""`
 	AllowedRepoURL     string `envconfig:"ALLOWED_REPO_URL" default:"https://github.com/davidmontoyago/pulumi-gcp-github-registry"`
+	// GitHub repositories trusted by the pool, replacing ALLOWED_REPO_URL when set.
+	// The ALLOWED_REPO_URL repository keeps its original IAM binding names when listed.
+	AllowedRepoURLs []string `envconfig:"ALLOWED_REPO_URLS" default:""`
+	// CI systems whose pipelines are trusted: github, gitlab, bitbucket, buildkite or circleci
+	CIProviders []string `envconfig:"CI_PROVIDERS" default:"github"`
+	// GitLab instance, which also issues the tokens
+	GitLabURL string `envconfig:"GITLAB_URL" default:"https://gitlab.com"`
+	// GitLab projects trusted by the pool, by numeric project ID
+	GitLabProjectIDs []string `envconfig:"GITLAB_PROJECT_IDS" default:""`
+	// Bitbucket workspace slug and UUID
+	BitbucketWorkspace     string `envconfig:"BITBUCKET_WORKSPACE" default:""`
+	BitbucketWorkspaceUUID string `envconfig:"BITBUCKET_WORKSPACE_UUID" default:""`
+	// Bitbucket repositories trusted by the pool, by UUID
+	BitbucketRepositoryUUIDs []string `envconfig:"BITBUCKET_REPOSITORY_UUIDS" default:""`
+	// Buildkite pipelines trusted by the pool, as organization/pipeline slugs
+	BuildkitePipelines []string `envconfig:"BUILDKITE_PIPELINES" default:""`
+	// CircleCI organization ID and the project IDs trusted by the pool
+	CircleCIOrgID      string   `envconfig:"CIRCLECI_ORG_ID" default:""`
+	CircleCIProjectIDs []string `envconfig:"CIRCLECI_PROJECT_IDS" default:""`
+	// GitHub server the repositories are hosted on: github.com, a GHE.com tenant or a GitHub Enterprise Server host
+	GitHubServerURL string `envconfig:"GITHUB_SERVER_URL" default:"https://github.com"`
+	// Issuer of the Actions OIDC tokens. Derived from GITHUB_SERVER_URL by default.
+	OIDCIssuerURL string `envconfig:"OIDC_ISSUER_URL" default:""`
+	// JSON Web Key Set of the issuer, for issuers Google can't reach (e.g. GitHub Enterprise Server behind a firewall)
+	OIDCJwksJSON string `envconfig:"OIDC_JWKS_JSON" default:""`
+	// Audiences the GitHub provider accepts instead of its resource name (e.g. the audience input of google-github-actions/auth)
+	AllowedAudiences []string `envconfig:"ALLOWED_AUDIENCES" default:""`
+	// Also require one of ALLOWED_AUDIENCES in the attribute condition
+	EnforceAudience bool `envconfig:"ENFORCE_AUDIENCE" default:"false"`
 	// Repository owner (username or organization) for additional security constraints
 	RepositoryOwner string `envconfig:"REPOSITORY_OWNER" default:""`
 	// Repository owner numeric ID for additional security constraints (recommended)
 	RepositoryOwnerID string `envconfig:"REPOSITORY_OWNER_ID" default:""`
+	// Trust every repository of REPOSITORY_OWNER_ID instead of the listed ones
+	TrustOwnerRepositories bool `envconfig:"TRUST_OWNER_REPOSITORIES" default:"false"`
+	// Glob patterns on the repository name (e.g. service-*) an owner repository must match, if any
+	RepositoryIncludePatterns []string `envconfig:"REPOSITORY_INCLUDE_PATTERNS" default:""`
+	// Glob patterns on the repository name excluding owner repositories (e.g. *-sandbox)
+	RepositoryExcludePatterns []string `envconfig:"REPOSITORY_EXCLUDE_PATTERNS" default:""`
+	// Git refs allowed to push, other workflows get read access (e.g. refs/heads/main,refs/tags/v*)
+	AllowedRefs []string `envconfig:"ALLOWED_REFS" default:""`
+	// Git ref types allowed to push: branch or tag
+	AllowedRefTypes []string `envconfig:"ALLOWED_REF_TYPES" default:""`
+	// Reusable workflows allowed to push, as job_workflow_ref values (e.g. my-org/workflows/.github/workflows/build.yml@refs/tags/v2)
+	AllowedReusableWorkflows []string `envconfig:"ALLOWED_REUSABLE_WORKFLOWS" default:""`
+	// GitHub deployment environments allowed to push (e.g. production)
+	AllowedEnvironments []string `envconfig:"ALLOWED_ENVIRONMENTS" default:""`
+	// Trust profiles as a JSON array, granting their own roles to the workflows matching their claims
+	TrustProfiles TrustProfileSpecs `envconfig:"TRUST_PROFILES" default:""`
 	// Repository numeric ID for additional security constraints (recommended)
 	RepositoryID             string `envconfig:"REPOSITORY_ID" default:""`
 	IdentityPoolProviderName string `envconfig:"IDENTITY_POOL_PROVIDER_NAME" default:"github-actions-provider"`
 	ResourcePrefix           string `envconfig:"RESOURCE_PREFIX" default:"ci"`
 	RepositoryName           string `envconfig:"REPOSITORY_NAME" default:"registry"`
-	CreateServiceAccount     bool   `envconfig:"CREATE_SERVICE_ACCOUNT" default:"false"`
-	ProtectResources         bool   `envconfig:"PROTECT_RESOURCES" default:"false"`
+	// Artifact Registry format: DOCKER, NPM, MAVEN, PYTHON, GO, APT, YUM or GENERIC
+	RepositoryFormat     string `envconfig:"REPOSITORY_FORMAT" default:"DOCKER"`
+	CreateServiceAccount bool   `envconfig:"CREATE_SERVICE_ACCOUNT" default:"false"`
+	// Additional roles as role or role=member entries, granted to the pipeline or to the member instead
+	// (e.g. roles/artifactregistry.repoAdmin=group:platform@example.com)
+	ExtraRepositoryRoles []string `envconfig:"EXTRA_REPOSITORY_ROLES" default:""`
+	ExtraProjectRoles    []string `envconfig:"EXTRA_PROJECT_ROLES" default:""`
+	ExtraBucketRoles     []string `envconfig:"EXTRA_BUCKET_ROLES" default:""`
+	// How the pipelines authenticate: direct, service-account or both. Defaults to direct, or both with CREATE_SERVICE_ACCOUNT.
+	AuthMode         string `envconfig:"AUTH_MODE" default:""`
+	ProtectResources bool   `envconfig:"PROTECT_RESOURCES" default:"false"`
 	// Number of recent images to retain
 	RecentImageRetentionCount int `envconfig:"RECENT_IMAGE_RETENTION_COUNT" default:"10"`
 	// Number of days (in duration format) after which old images are deleted
 	OldImageDeletionDays string `envconfig:"OLD_IMAGE_DELETION_DAYS" default:"30d"`
+	// Prevent Docker tags from being overwritten or deleted. Tagged versions are then never cleaned up.
+	ImmutableTags bool `envconfig:"IMMUTABLE_TAGS" default:"false"`
+	// Cleanup policies as a JSON array, replacing the ones derived from the retention count and deletion age
+	CleanupPolicies CleanupPolicySpecs `envconfig:"CLEANUP_POLICIES" default:""`
+	// Evaluate the cleanup policies without deleting anything
+	CleanupPolicyDryRun bool `envconfig:"CLEANUP_POLICY_DRY_RUN" default:"false"`
+	// Automatic vulnerability scanning of pushed artifacts: enabled, disabled or inherited from the project
+	VulnerabilityScanning string `envconfig:"VULNERABILITY_SCANNING" default:"inherited"`
 	// Number of days after which SBOMs are deleted
 	SBOMRetentionDays int `envconfig:"SBOM_RETENTION_DAYS" default:"365"`
+	// Project roles granting SBOM uploads: legacy predefined roles, a least-privilege custom role, or both while migrating
+	SBOMRole string `envconfig:"SBOM_ROLE" default:"legacy"`
+	// Limit the bucket access of the project-level pipeline roles to the SBOM bucket with IAM conditions
+	ScopeProjectIAM bool `envconfig:"SCOPE_PROJECT_IAM" default:"false"`
+	// RFC 3339 timestamp after which the project-level pipeline roles no longer apply (e.g. 2026-12-31T00:00:00Z)
+	ProjectIAMExpiry string `envconfig:"PROJECT_IAM_EXPIRY" default:""`
+	// Upstream registries to mirror through pull-through cache repositories (e.g. docker-hub,ghcr,quay,name=https://registry.example.com)
+	RemoteCaches []string `envconfig:"REMOTE_CACHES" default:""`
+	// Upstream usernames keyed by remote cache name (e.g. docker-hub:my-user)
+	RemoteCacheUsernames map[string]string `envconfig:"REMOTE_CACHE_USERNAMES" default:""`
+	// Upstream passwords or access tokens keyed by remote cache name. Stored in Secret Manager.
+	RemoteCachePasswords map[string]string `envconfig:"REMOTE_CACHE_PASSWORDS" default:""`
+	// Create a virtual repository that serves the registry and the remote caches from a single URL
+	VirtualRepository bool `envconfig:"VIRTUAL_REPOSITORY" default:"false"`
+	// Virtual repository priorities keyed by remote cache name (e.g. ghcr:20,docker-hub:10). The registry always comes first.
+	VirtualRepositoryPriorities map[string]int `envconfig:"VIRTUAL_REPOSITORY_PRIORITIES" default:""`
+	// Repositories to manage as a JSON array of repository specs. Defaults to the single REPOSITORY_NAME repository.
+	Repositories RepositorySpecs `envconfig:"REPOSITORIES" default:""`
+	// IAM members granted pull access on every repository, e.g. serviceAccount:deployer@partner.iam.gserviceaccount.com,
+	// or service agents by project number, e.g. serviceAgent:cloud-run:123456789012
+	ReaderMembers []string `envconfig:"READER_MEMBERS" default:""`
+	// Environment tiers to create a repository each for, lowest first (e.g. dev,staging,prod)
+	EnvironmentTiers []string `envconfig:"ENVIRONMENT_TIERS" default:""`
+	// Workflow allowed to promote images to the upper tiers (e.g. .github/workflows/promote.yml)
+	PromotionWorkflow string `envconfig:"PROMOTION_WORKFLOW" default:""`
+	// Git ref the promotion workflow must run from
+	PromotionRef string `envconfig:"PROMOTION_REF" default:"refs/heads/main"`
+	// Existing Cloud KMS crypto key to encrypt the repositories with (projects/*/locations/*/keyRings/*/cryptoKeys/*)
+	KMSKeyName string `envconfig:"KMS_KEY_NAME" default:""`
+	// Existing Cloud KMS crypto key for the SBOM bucket. Defaults to KMS_KEY_NAME, but must be in GCP_REGION.
+	SBOMBucketKMSKeyName string `envconfig:"SBOM_BUCKET_KMS_KEY_NAME" default:""`
+	// Create a key ring and crypto key per location instead of using existing keys
+	CreateKMSKey bool `envconfig:"CREATE_KMS_KEY" default:"false"`
+	// Rotation period of the created crypto keys, in seconds (90 days by default)
+	KMSKeyRotationPeriod string `envconfig:"KMS_KEY_ROTATION_PERIOD" default:"7776000s"`
 }
 
 // LoadConfig loads configuration from environment variables
@@ -50,17 +153,76 @@ func LoadConfig() (*Config, error) {
 		config.RepositoryLocation = config.GCPRegion
 	}
 
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	log.Printf("Configuration loaded successfully:")
 	log.Printf("  GCP Project: %s", config.GCPProject)
+
+	if config.identityProject() != config.GCPProject || config.sbomBucketProject() != config.GCPProject || config.registryProject() != config.GCPProject {
+		log.Printf("  Projects: identity %s, registry %s, SBOM bucket %s", config.identityProject(), config.registryProject(), config.sbomBucketProject())
+	}
 	log.Printf("  GCP Region: %s", config.GCPRegion)
 	log.Printf("  Repository Location: %s", config.RepositoryLocation)
 	log.Printf("  Resource Prefix: %s", config.ResourcePrefix)
 	log.Printf("  Repository Name: %s", config.RepositoryName)
+	log.Printf("  Repository Format: %s", config.RepositoryFormat)
+
+	for _, repository := range config.Repositories {
+		log.Printf("  Repository: %s (%s)", repository.Name, repository.Format)
+	}
 	log.Printf("  Allowed Repo URL: %s", config.AllowedRepoURL)
+
+	if len(config.AllowedRepoURLs) > 0 {
+		log.Printf("  Allowed Repo URLs: %v", config.AllowedRepoURLs)
+	}
+
+	log.Printf("  Auth Mode: %s", config.AuthMode)
+
+	if len(config.ExtraRepositoryRoles)+len(config.ExtraProjectRoles)+len(config.ExtraBucketRoles) > 0 {
+		log.Printf("  Extra Roles: repository %v, project %v, bucket %v", config.ExtraRepositoryRoles, config.ExtraProjectRoles, config.ExtraBucketRoles)
+	}
 	log.Printf("  Protect Resources: %t", config.ProtectResources)
 	log.Printf("  Recent Image Retention Count: %d", config.RecentImageRetentionCount)
 	log.Printf("  Old Image Deletion Days: %s", config.OldImageDeletionDays)
+	log.Printf("  Immutable Tags: %t", config.ImmutableTags)
+
+	for _, policy := range config.CleanupPolicies {
+		log.Printf("  Cleanup Policy: %s (%s)", policy.ID, policy.Action)
+	}
+
+	log.Printf("  Cleanup Policy Dry Run: %t", config.CleanupPolicyDryRun)
+	log.Printf("  Vulnerability Scanning: %s", config.VulnerabilityScanning)
 	log.Printf("  SBOM Retention Days: %d", config.SBOMRetentionDays)
+	log.Printf("  SBOM Role: %s", config.SBOMRole)
+
+	if config.ScopeProjectIAM || config.ProjectIAMExpiry != "" {
+		log.Printf("  Project IAM Conditions: scoped %t, expiry %q", config.ScopeProjectIAM, config.ProjectIAMExpiry)
+	}
+
+	if len(config.RemoteCaches) > 0 {
+		log.Printf("  Remote Caches: %v", config.RemoteCaches)
+	}
+
+	log.Printf("  Virtual Repository: %t", config.VirtualRepository)
+
+	if len(config.ReaderMembers) > 0 {
+		log.Printf("  Reader Members: %v", config.ReaderMembers)
+	}
+
+	if config.CreateKMSKey {
+		log.Printf("  KMS Key: created, rotated every %s", config.KMSKeyRotationPeriod)
+	} else if config.KMSKeyName != "" || config.SBOMBucketKMSKeyName != "" {
+		log.Printf("  KMS Key: %s", config.KMSKeyName)
+		log.Printf("  SBOM Bucket KMS Key: %s", config.sbomBucketKMSKeyName())
+	}
+
+	if len(config.EnvironmentTiers) > 0 {
+		log.Printf("  Environment Tiers: %v", config.EnvironmentTiers)
+		log.Printf("  Promotion Workflow: %s@%s", config.PromotionWorkflow, config.PromotionRef)
+	}
 
 	if config.RepositoryOwner != "" {
 		log.Printf("  Repository Owner: %s", config.RepositoryOwner)
@@ -70,11 +232,127 @@ func LoadConfig() (*Config, error) {
 		log.Printf("  Repository Owner ID: %s", config.RepositoryOwnerID)
 	}
 
+	if config.TrustOwnerRepositories {
+		log.Printf("  Trust Owner Repositories: include %v, exclude %v", config.RepositoryIncludePatterns, config.RepositoryExcludePatterns)
+	}
+
 	if config.RepositoryID != "" {
 		log.Printf("  Repository ID: %s", config.RepositoryID)
 	}
 
+	if writeAccessGated(&config) {
+		log.Printf("  Allowed Refs: %v", config.AllowedRefs)
+		log.Printf("  Allowed Ref Types: %v", config.AllowedRefTypes)
+		log.Printf("  Allowed Environments: %v", config.AllowedEnvironments)
+		log.Printf("  Allowed Reusable Workflows: %v", config.AllowedReusableWorkflows)
+	}
+
+	for _, profile := range config.TrustProfiles {
+		log.Printf("  Trust Profile: %s (repository roles %v, project roles %v, bucket roles %v)",
+			profile.Name, profile.RepositoryRoles, profile.ProjectRoles, profile.BucketRoles)
+	}
+
+	log.Printf("  CI Providers: %v", config.ciProviders())
 	log.Printf("  Identity Pool Provider Name: %s", config.IdentityPoolProviderName)
+	log.Printf("  GitHub Server URL: %s", config.GitHubServerURL)
+	log.Printf("  OIDC Issuer URL: %s", config.oidcIssuerURL())
+
+	if config.OIDCJwksJSON != "" {
+		log.Printf("  OIDC JWKS: uploaded")
+	}
+
+	if len(config.AllowedAudiences) > 0 {
+		log.Printf("  Allowed Audiences: %v (enforced in condition: %t)", config.AllowedAudiences, config.EnforceAudience)
+	}
 
 	return &config, nil
 }
+
+// validate checks the configuration for values that would produce invalid resources and normalizes them
+func (c *Config) validate() error {
+	format, err := lookupRepositoryFormat(c.RepositoryFormat)
+	if err != nil {
+		return fmt.Errorf("invalid REPOSITORY_FORMAT: %w", err)
+	}
+
+	c.RepositoryFormat = format.name
+
+	c.VulnerabilityScanning, err = lookupVulnerabilityScanning(c.VulnerabilityScanning)
+	if err != nil {
+		return fmt.Errorf("invalid VULNERABILITY_SCANNING: %w", err)
+	}
+
+	c.SBOMRole, err = lookupSBOMRole(c.SBOMRole)
+	if err != nil {
+		return fmt.Errorf("invalid SBOM_ROLE: %w", err)
+	}
+
+	err = validateProjectIAMConditions(c)
+	if err != nil {
+		return fmt.Errorf("invalid project IAM conditions: %w", err)
+	}
+
+	repositories, err := resolveRepositories(c)
+	if err != nil {
+		return fmt.Errorf("invalid REPOSITORIES or ENVIRONMENT_TIERS: %w", err)
+	}
+
+	remoteCaches, err := parseRemoteCaches(c)
+	if err != nil {
+		return fmt.Errorf("invalid REMOTE_CACHES: %w", err)
+	}
+
+	if c.VirtualRepository {
+		// The primary repository is the first upstream of the virtual repository
+		if primary := repositories[0]; primary.format.name != FormatDocker {
+			return fmt.Errorf("VIRTUAL_REPOSITORY requires a %s primary repository, got %s for %s", FormatDocker, primary.format.name, primary.name)
+		}
+
+		_, _, err = resolveVirtualUpstreamPriorities(c, remoteCaches)
+		if err != nil {
+			return fmt.Errorf("invalid VIRTUAL_REPOSITORY_PRIORITIES: %w", err)
+		}
+	}
+
+	err = validateIssuer(c)
+	if err != nil {
+		return fmt.Errorf("invalid OIDC issuer settings: %w", err)
+	}
+
+	_, err = identityProviders(c)
+	if err != nil {
+		return fmt.Errorf("invalid CI providers: %w", err)
+	}
+
+	err = validateWriteAccess(c)
+	if err != nil {
+		return fmt.Errorf("invalid write access restrictions: %w", err)
+	}
+
+	err = validateTrustProfiles(c)
+	if err != nil {
+		return fmt.Errorf("invalid TRUST_PROFILES: %w", err)
+	}
+
+	err = validateAuthMode(c)
+	if err != nil {
+		return fmt.Errorf("invalid AUTH_MODE: %w", err)
+	}
+
+	err = validateExtraRoles(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = resolveReaderMembers(c)
+	if err != nil {
+		return fmt.Errorf("invalid READER_MEMBERS: %w", err)
+	}
+
+	err = validateEncryption(c)
+	if err != nil {
+		return fmt.Errorf("invalid encryption settings: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package ci
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Artifact Registry repository formats supported by the component
+const (
+	FormatDocker  = "DOCKER"
+	FormatNPM     = "NPM"
+	FormatMaven   = "MAVEN"
+	FormatPython  = "PYTHON"
+	FormatGo      = "GO"
+	FormatApt     = "APT"
+	FormatYum     = "YUM"
+	FormatGeneric = "GENERIC"
+)
+
+// repositoryFormat describes how a repository of a given format is provisioned and addressed
+type repositoryFormat struct {
+	name        string
+	description string
+	// value for the "purpose" label
+	purpose string
+	// whether versions can be garbage collected by age without breaking downstream consumers
+	deleteOldVersions bool
+	// endpoint builds the URL clients use to push to and pull from the repository
+	endpoint func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput
+}
+
+var repositoryFormats = map[string]repositoryFormat{
+	FormatDocker: {
+		name:              FormatDocker,
+		description:       "CI/CD Docker image registry",
+		purpose:           "docker-images",
+		deleteOldVersions: true,
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("%s-docker.pkg.dev/%s/%s", location, project, repositoryID)
+		},
+	},
+	// Language package formats: published versions are pinned by downstream lockfiles,
+	// so they are never deleted by age.
+	FormatNPM: {
+		name:        FormatNPM,
+		description: "CI/CD npm package registry",
+		purpose:     "npm-packages",
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("https://%s-npm.pkg.dev/%s/%s/", location, project, repositoryID)
+		},
+	},
+	FormatMaven: {
+		name:        FormatMaven,
+		description: "CI/CD Maven artifact registry",
+		purpose:     "maven-artifacts",
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("https://%s-maven.pkg.dev/%s/%s", location, project, repositoryID)
+		},
+	},
+	FormatPython: {
+		name:        FormatPython,
+		description: "CI/CD Python package registry",
+		purpose:     "python-packages",
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("https://%s-python.pkg.dev/%s/%s/", location, project, repositoryID)
+		},
+	},
+	FormatGo: {
+		name:        FormatGo,
+		description: "CI/CD Go module registry",
+		purpose:     "go-modules",
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("https://%s-go.pkg.dev/%s/%s", location, project, repositoryID)
+		},
+	},
+	// OS package formats rotate like images, so old versions are cleaned up
+	FormatApt: {
+		name:              FormatApt,
+		description:       "CI/CD Apt package registry",
+		purpose:           "apt-packages",
+		deleteOldVersions: true,
+		// Apt repositories are addressed as a sources.list entry rather than a single URL
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("ar+https://%s-apt.pkg.dev/projects/%s %s main", location, project, repositoryID)
+		},
+	},
+	FormatYum: {
+		name:              FormatYum,
+		description:       "CI/CD Yum package registry",
+		purpose:           "yum-packages",
+		deleteOldVersions: true,
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("https://%s-yum.pkg.dev/projects/%s/%s", location, project, repositoryID)
+		},
+	},
+	// Generic artifacts have no pkg.dev host, they are uploaded and downloaded through the API
+	FormatGeneric: {
+		name:              FormatGeneric,
+		description:       "CI/CD generic artifact registry",
+		purpose:           "generic-artifacts",
+		deleteOldVersions: true,
+		endpoint: func(location, project string, repositoryID pulumi.StringOutput) pulumi.StringOutput {
+			return pulumi.Sprintf("https://artifactregistry.googleapis.com/v1/projects/%s/locations/%s/repositories/%s", project, location, repositoryID)
+		},
+	},
+}
+
+// lookupRepositoryFormat resolves a format name (case-insensitive) to its settings. Empty defaults to Docker.
+func lookupRepositoryFormat(name string) (repositoryFormat, error) {
+	if name == "" {
+		return repositoryFormats[FormatDocker], nil
+	}
+
+	format, ok := repositoryFormats[strings.ToUpper(name)]
+	if !ok {
+		supported := make([]string, 0, len(repositoryFormats))
+		for supportedName := range repositoryFormats {
+			supported = append(supported, supportedName)
+		}
+
+		sort.Strings(supported)
+
+		return repositoryFormat{}, fmt.Errorf("unsupported repository format %q, must be one of: %s", name, strings.Join(supported, ", "))
+	}
+
+	return format, nil
+}
@@ -0,0 +1,122 @@
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Public GitHub and its Actions OIDC issuer
+const (
+	githubDotComHost      = "github.com"
+	githubDotComIssuerURL = "https://token.actions.githubusercontent.com"
+	// GHE.com data residency tenants are subdomains of ghe.com, e.g. my-enterprise.ghe.com
+	gheDotComDomain = ".ghe.com"
+)
+
+// maxAllowedAudiences is the number of audiences a workload identity pool provider accepts
+const maxAllowedAudiences = 10
+
+// githubServerHost returns the lower-cased host of GITHUB_SERVER_URL, github.com when unset
+func (c *Config) githubServerHost() string {
+	if c.GitHubServerURL == "" {
+		return githubDotComHost
+	}
+
+	serverURL, err := url.Parse(c.GitHubServerURL)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(serverURL.Host)
+}
+
+// oidcIssuerURL returns the issuer of the Actions OIDC tokens. Unless OIDC_ISSUER_URL overrides it,
+// it's derived from the GitHub server:
+//   - github.com: https://token.actions.githubusercontent.com
+//   - GHE.com: https://token.actions.<subdomain>.ghe.com
+//   - GitHub Enterprise Server: https://<hostname>/_services/token
+func (c *Config) oidcIssuerURL() string {
+	if c.OIDCIssuerURL != "" {
+		return strings.TrimSuffix(c.OIDCIssuerURL, "/")
+	}
+
+	host := c.githubServerHost()
+
+	switch {
+	case host == githubDotComHost:
+		return githubDotComIssuerURL
+	case strings.HasSuffix(host, gheDotComDomain):
+		return fmt.Sprintf("https://token.actions.%s", host)
+	default:
+		return fmt.Sprintf("https://%s/_services/token", host)
+	}
+}
+
+// validateIssuer checks the GitHub server, the OIDC issuer, its audiences and the uploaded JWKS
+func validateIssuer(config *Config) error {
+	if config.GitHubServerURL != "" {
+		serverURL, err := url.Parse(config.GitHubServerURL)
+		if err != nil || serverURL.Scheme != "https" || serverURL.Host == "" || strings.Trim(serverURL.Path, "/") != "" {
+			return fmt.Errorf("GITHUB_SERVER_URL must be an https URL without a path (e.g. https://github.example.com), got %q", config.GitHubServerURL)
+		}
+	}
+
+	if config.OIDCIssuerURL != "" {
+		issuerURL, err := url.Parse(config.OIDCIssuerURL)
+		if err != nil || issuerURL.Scheme != "https" || issuerURL.Host == "" || issuerURL.RawQuery != "" || issuerURL.Fragment != "" {
+			return fmt.Errorf("OIDC_ISSUER_URL must be an https URL without a query or fragment, got %q", config.OIDCIssuerURL)
+		}
+	}
+
+	err := validateAudiences(config)
+	if err != nil {
+		return err
+	}
+
+	if config.OIDCJwksJSON != "" {
+		// Google only checks the JWKS when the provider is created, fail before anything is deployed
+		var jwks struct {
+			Keys []json.RawMessage `json:"keys"`
+		}
+
+		err = json.Unmarshal([]byte(config.OIDCJwksJSON), &jwks)
+		if err != nil {
+			return fmt.Errorf("OIDC_JWKS_JSON must be a JSON Web Key Set: %w", err)
+		}
+
+		if len(jwks.Keys) == 0 {
+			return fmt.Errorf("OIDC_JWKS_JSON must contain at least one key")
+		}
+	}
+
+	return nil
+}
+
+// validateAudiences checks the custom audiences of the GitHub provider
+func validateAudiences(config *Config) error {
+	if len(config.AllowedAudiences) > maxAllowedAudiences {
+		return fmt.Errorf("at most %d ALLOWED_AUDIENCES are allowed, got %d", maxAllowedAudiences, len(config.AllowedAudiences))
+	}
+
+	seen := map[string]bool{}
+
+	for _, audience := range config.AllowedAudiences {
+		if strings.TrimSpace(audience) == "" {
+			return fmt.Errorf("allowed audiences can't be empty")
+		}
+
+		if seen[audience] {
+			return fmt.Errorf("audience %q is allowed more than once", audience)
+		}
+
+		seen[audience] = true
+	}
+
+	if config.EnforceAudience && len(config.AllowedAudiences) == 0 {
+		return fmt.Errorf("ENFORCE_AUDIENCE requires ALLOWED_AUDIENCES")
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/kms"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/storage"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// minKMSKeyRotationSeconds is the shortest rotation period Cloud KMS accepts (1 day)
+const minKMSKeyRotationSeconds = 86400
+
+var (
+	kmsKeyNamePattern        = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	kmsRotationPeriodPattern = regexp.MustCompile(`^([0-9]+)s$`)
+)
+
+// encryptionKeys are the customer-managed keys used to encrypt the repositories and the SBOM bucket
+type encryptionKeys struct {
+	// nil when Google-managed encryption is used
+	repository pulumi.StringPtrInput
+	bucket     pulumi.StringInput
+	// The service agents must be able to use the keys before the encrypted resources are created
+	dependencies []pulumi.Resource
+}
+
+// validateEncryption checks the CMEK settings. Keys must live in the same location as the resources they encrypt.
+func validateEncryption(config *Config) error {
+	if config.CreateKMSKey {
+		if config.KMSKeyName != "" || config.SBOMBucketKMSKeyName != "" {
+			return fmt.Errorf("CREATE_KMS_KEY can't be combined with KMS_KEY_NAME or SBOM_BUCKET_KMS_KEY_NAME")
+		}
+
+		matches := kmsRotationPeriodPattern.FindStringSubmatch(config.KMSKeyRotationPeriod)
+		if matches == nil {
+			return fmt.Errorf("KMS_KEY_ROTATION_PERIOD must be a duration in seconds (e.g. 7776000s), got %q", config.KMSKeyRotationPeriod)
+		}
+
+		seconds, err := strconv.Atoi(matches[1])
+		if err != nil || seconds < minKMSKeyRotationSeconds {
+			return fmt.Errorf("KMS_KEY_ROTATION_PERIOD must be at least %ds, got %q", minKMSKeyRotationSeconds, config.KMSKeyRotationPeriod)
+		}
+
+		return nil
+	}
+
+	if config.KMSKeyName != "" {
+		err := validateKMSKeyLocation("KMS_KEY_NAME", config.KMSKeyName, config.RepositoryLocation)
+		if err != nil {
+			return err
+		}
+	}
+
+	bucketKeyName := config.sbomBucketKMSKeyName()
+	if bucketKeyName != "" {
+		err := validateKMSKeyLocation("SBOM_BUCKET_KMS_KEY_NAME", bucketKeyName, config.GCPRegion)
+		if err != nil {
+			return fmt.Errorf("%w, set SBOM_BUCKET_KMS_KEY_NAME to a key in the bucket location", err)
+		}
+	}
+
+	return nil
+}
+
+func validateKMSKeyLocation(variable, keyName, location string) error {
+	matches := kmsKeyNamePattern.FindStringSubmatch(keyName)
+	if matches == nil {
+		return fmt.Errorf("%s must be a crypto key name (projects/*/locations/*/keyRings/*/cryptoKeys/*), got %q", variable, keyName)
+	}
+
+	if !strings.EqualFold(matches[1], location) {
+		return fmt.Errorf("%s is in location %s but must be in %s", variable, matches[1], location)
+	}
+
+	return nil
+}
+
+// sbomBucketKMSKeyName returns the existing key for the SBOM bucket, which defaults to the repository key
+func (c *Config) sbomBucketKMSKeyName() string {
+	if c.SBOMBucketKMSKeyName != "" {
+		return c.SBOMBucketKMSKeyName
+	}
+
+	return c.KMSKeyName
+}
+
+// deployEncryptionKeys creates or looks up the CMEK keys and lets the Artifact Registry and Cloud Storage service agents use them
+func (r *GithubGoogleRegistry) deployEncryptionKeys(ctx *pulumi.Context, registryAPI pulumi.Resource) (*encryptionKeys, error) {
+	keys := &encryptionKeys{}
+
+	var repositoryKey, bucketKey pulumi.StringOutput
+
+	// Without a key, the resource is left with Google-managed encryption
+	var encryptRepository, encryptBucket bool
+
+	switch {
+	case r.config.CreateKMSKey:
+		kmsAPI, err := r.enableRegistryAPI(ctx, "cloudkms", "cloudkms.googleapis.com")
+		if err != nil {
+			return nil, fmt.Errorf("failed to enable Cloud KMS API: %w", err)
+		}
+
+		repositoryKey, err = r.newCryptoKey(ctx, r.config.RepositoryLocation, kmsAPI)
+		if err != nil {
+			return nil, err
+		}
+
+		bucketKey = repositoryKey
+		encryptRepository, encryptBucket = true, true
+
+		// Multi-region repositories and single region buckets can't share a key
+		if !strings.EqualFold(r.config.GCPRegion, r.config.RepositoryLocation) {
+			bucketKey, err = r.newCryptoKey(ctx, r.config.GCPRegion, kmsAPI)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case r.config.KMSKeyName != "" || r.config.SBOMBucketKMSKeyName != "":
+		repositoryKey = pulumi.String(r.config.KMSKeyName).ToStringOutput()
+		bucketKey = pulumi.String(r.config.sbomBucketKMSKeyName()).ToStringOutput()
+		encryptRepository = r.config.KMSKeyName != ""
+		encryptBucket = r.config.sbomBucketKMSKeyName() != ""
+	default:
+		return keys, nil
+	}
+
+	type agentGrant struct {
+		name  string
+		key   pulumi.StringOutput
+		agent pulumi.StringOutput
+		// IAM rejects members that don't exist yet, the grant must wait for the service agent
+		dependencies []pulumi.Resource
+	}
+
+	var grants []agentGrant
+
+	if encryptRepository {
+		// The Artifact Registry service agent is only provisioned on first use, create it once the API is enabled
+		agent, err := projects.NewServiceIdentity(ctx, r.NewResourceName("artifactregistry", "agent", 63), &projects.ServiceIdentityArgs{
+			Project: pulumi.String(r.config.registryProject()),
+			Service: pulumi.String("artifactregistry.googleapis.com"),
+		},
+			pulumi.Parent(r),
+			pulumi.DependsOn([]pulumi.Resource{registryAPI}),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Artifact Registry service agent: %w", err)
+		}
+
+		grants = append(grants, agentGrant{
+			name:         "artifactregistry",
+			key:          repositoryKey,
+			agent:        agent.Member,
+			dependencies: []pulumi.Resource{registryAPI, agent},
+		})
+	}
+
+	if encryptBucket {
+		// Looking up the Cloud Storage service agent creates it when the project has none yet
+		agent, err := storage.GetProjectServiceAccount(ctx, &storage.GetProjectServiceAccountArgs{
+			Project: pulumi.StringRef(r.config.sbomBucketProject()),
+		}, pulumi.Parent(r))
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Cloud Storage service agent: %w", err)
+		}
+
+		grants = append(grants, agentGrant{
+			name:  "storage",
+			key:   bucketKey,
+			agent: pulumi.String(agent.Member).ToStringOutput(),
+		})
+	}
+
+	for _, grant := range grants {
+		member, err := kms.NewCryptoKeyIAMMember(ctx, fmt.Sprintf("%s-kms-%s-agent", r.config.ResourcePrefix, grant.name), &kms.CryptoKeyIAMMemberArgs{
+			CryptoKeyId: grant.key,
+			Role:        pulumi.String("roles/cloudkms.cryptoKeyEncrypterDecrypter"),
+			Member:      grant.agent,
+		},
+			pulumi.Parent(r),
+			pulumi.DependsOn(grant.dependencies),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to grant %s service agent access to the KMS key: %w", grant.name, err)
+		}
+
+		keys.dependencies = append(keys.dependencies, member)
+		r.KMSKeyIAMMembers = append(r.KMSKeyIAMMembers, member)
+	}
+
+	if encryptRepository {
+		keys.repository = repositoryKey
+		r.RepositoryKMSKeyName = repositoryKey
+	}
+
+	if encryptBucket {
+		keys.bucket = bucketKey
+		r.SBOMBucketKMSKeyName = bucketKey
+	}
+
+	return keys, nil
+}
+
+// newCryptoKey creates a key ring and a rotating crypto key in the given location and returns the key name
+func (r *GithubGoogleRegistry) newCryptoKey(ctx *pulumi.Context, location string, kmsAPI pulumi.Resource) (pulumi.StringOutput, error) {
+	location = strings.ToLower(location)
+
+	keyRingName := r.NewResourceName(location, "keyring", 63)
+
+	// Key rings and keys can't be deleted from GCP, dropping them from the stack must not lose access to the data
+	keyRing, err := kms.NewKeyRing(ctx, keyRingName, &kms.KeyRingArgs{
+		Name:     pulumi.String(keyRingName),
+		Location: pulumi.String(location),
+		Project:  pulumi.String(r.config.registryProject()),
+	},
+		pulumi.Parent(r),
+		pulumi.RetainOnDelete(true),
+		pulumi.DependsOn([]pulumi.Resource{kmsAPI}),
+	)
+	if err != nil {
+		return pulumi.StringOutput{}, fmt.Errorf("failed to create KMS key ring in %s: %w", location, err)
+	}
+
+	cryptoKey, err := kms.NewCryptoKey(ctx, r.NewResourceName(location, "artifacts-key", 63), &kms.CryptoKeyArgs{
+		Name:           pulumi.String("artifacts"),
+		KeyRing:        keyRing.ID(),
+		Purpose:        pulumi.String("ENCRYPT_DECRYPT"),
+		RotationPeriod: pulumi.String(r.config.KMSKeyRotationPeriod),
+		Labels: pulumi.StringMap{
+			"managed-by": pulumi.String("pulumi"),
+			"purpose":    pulumi.String("artifacts-encryption"),
+		},
+	},
+		pulumi.Parent(r),
+		pulumi.Protect(r.config.ProtectResources),
+		pulumi.RetainOnDelete(true),
+	)
+	if err != nil {
+		return pulumi.StringOutput{}, fmt.Errorf("failed to create KMS crypto key in %s: %w", location, err)
+	}
+
+	r.KMSCryptoKeys = append(r.KMSCryptoKeys, cryptoKey)
+
+	return cryptoKey.ID().ToStringOutput(), nil
+}
@@ -0,0 +1,242 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// GitHub naming rules for repository owners and names
+const (
+	maxGitHubOwnerLength      = 39
+	maxGitHubRepositoryLength = 100
+)
+
+var (
+	// Owners are alphanumeric with single hyphens. Enterprise managed users are suffixed with _shortcode.
+	githubOwnerPattern      = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)*(_[A-Za-z0-9]+)?$`)
+	githubRepositoryPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// repositoryGlobPattern restricts repository patterns to valid GitHub repository name characters and wildcards
+var repositoryGlobPattern = regexp.MustCompile(`^[A-Za-z0-9._*?-]+$`)
+
+// pipelinePrincipal is the principal set of the workflows of one trusted GitHub repository
+type pipelinePrincipal struct {
+	// owner/repo
+	repository string
+	id         pulumi.StringOutput
+	// Principal set of the workflows allowed to push. Same as id unless pushes are restricted to some refs or environments.
+	writeID pulumi.StringOutput
+	// Whether writeID is restricted, so the other workflows only get read access
+	gated bool
+	// Principal sets of the trust profiles of the repository. When set, they get the repository,
+	// project and bucket roles instead of the principal.
+	profiles []pipelinePrincipal
+	// Trust profile of a profile principal set
+	profile *TrustProfileSpec
+	// Suffix telling apart the IAM bindings of each repository. The repository of ALLOWED_REPO_URL
+	// keeps the binding names it had before multiple repositories were trusted, so it has none.
+	key string
+}
+
+// bindingName returns the name of an IAM binding for the principal
+func (p pipelinePrincipal) bindingName(name string) string {
+	if p.key == "" {
+		return name
+	}
+
+	return fmt.Sprintf("%s-%s", name, p.key)
+}
+
+// allowedRepositories returns the owner/repo names of the trusted GitHub repositories.
+// ALLOWED_REPO_URLS replaces ALLOWED_REPO_URL when set. With owner-wide trust, no repository
+// is listed and nil is returned.
+func allowedRepositories(config *Config) ([]string, error) {
+	if config.TrustOwnerRepositories {
+		return nil, validateOwnerTrust(config)
+	}
+
+	if len(config.RepositoryIncludePatterns) > 0 || len(config.RepositoryExcludePatterns) > 0 {
+		return nil, fmt.Errorf("REPOSITORY_INCLUDE_PATTERNS and REPOSITORY_EXCLUDE_PATTERNS require TRUST_OWNER_REPOSITORIES")
+	}
+
+	urls := config.AllowedRepoURLs
+	if len(urls) == 0 {
+		urls = []string{config.AllowedRepoURL}
+	}
+
+	repositories := make([]string, 0, len(urls))
+	seen := map[string]bool{}
+	// Repositories are told apart in the binding names by their member key, which drops the owner separator
+	keys := map[string]string{}
+
+	for _, url := range urls {
+		repository, err := extractRepoName(url, config.githubServerHost())
+		if err != nil {
+			return nil, err
+		}
+
+		// GitHub names are case-insensitive
+		if seen[strings.ToLower(repository)] {
+			return nil, fmt.Errorf("repository %q is allowed more than once", repository)
+		}
+
+		seen[strings.ToLower(repository)] = true
+
+		key := memberKey(repository)
+		if other, ok := keys[key]; ok {
+			return nil, fmt.Errorf("repositories %q and %q can't both be allowed, their IAM binding names would collide", other, repository)
+		}
+
+		keys[key] = repository
+
+		owner, _, _ := strings.Cut(repository, "/")
+		if config.RepositoryOwner != "" && !strings.EqualFold(owner, config.RepositoryOwner) {
+			return nil, fmt.Errorf("repository %q is not owned by REPOSITORY_OWNER %s", repository, config.RepositoryOwner)
+		}
+
+		repositories = append(repositories, repository)
+	}
+
+	// A repository ID pins a single repository, so it would lock out the others
+	if config.RepositoryID != "" && len(repositories) > 1 {
+		return nil, fmt.Errorf("REPOSITORY_ID can only be set when a single repository is allowed")
+	}
+
+	return repositories, nil
+}
+
+// validateOwnerTrust checks the owner-wide trust settings
+func validateOwnerTrust(config *Config) error {
+	// Owner names can be renamed and then registered by someone else, the numeric ID can't
+	if config.RepositoryOwnerID == "" {
+		return fmt.Errorf("TRUST_OWNER_REPOSITORIES requires REPOSITORY_OWNER_ID")
+	}
+
+	if len(config.AllowedRepoURLs) > 0 || config.RepositoryID != "" {
+		return fmt.Errorf("TRUST_OWNER_REPOSITORIES can't be combined with ALLOWED_REPO_URLS or REPOSITORY_ID")
+	}
+
+	// There is no single repository to resolve a relative workflow path against
+	if len(config.EnvironmentTiers) > 0 && strings.HasPrefix(config.PromotionWorkflow, ".github/") {
+		return fmt.Errorf("PROMOTION_WORKFLOW must be qualified with its repository (e.g. my-org/my-repo/.github/workflows/promote.yml) with TRUST_OWNER_REPOSITORIES")
+	}
+
+	for _, pattern := range append(append([]string{}, config.RepositoryIncludePatterns...), config.RepositoryExcludePatterns...) {
+		if !repositoryGlobPattern.MatchString(pattern) {
+			return fmt.Errorf("repository pattern %q may only contain letters, digits, '.', '_', '-' and the wildcards '*' and '?'", pattern)
+		}
+	}
+
+	return nil
+}
+
+// repositoryNameRegexp compiles a glob on the repository name into an RE2 expression matching
+// the owner/repo value of attribute.repository
+func repositoryNameRegexp(pattern string) string {
+	var expression strings.Builder
+
+	expression.WriteString("^[^/]+/")
+
+	for _, char := range pattern {
+		switch char {
+		case '*':
+			expression.WriteString("[^/]*")
+		case '?':
+			expression.WriteString("[^/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	expression.WriteString("$")
+
+	return expression.String()
+}
+
+// ownerRepositoriesCondition returns the condition trusting the repositories of REPOSITORY_OWNER_ID
+// that match an include pattern, if any, and no exclude pattern
+func ownerRepositoriesCondition(config *Config) celExpr {
+	includes := make([]celExpr, 0, len(config.RepositoryIncludePatterns))
+	for _, pattern := range config.RepositoryIncludePatterns {
+		includes = append(includes, celMatches("attribute.repository", repositoryNameRegexp(pattern)))
+	}
+
+	conditions := []celExpr{
+		celEquals("attribute.repository_owner_id", config.RepositoryOwnerID),
+		celOr(includes...),
+	}
+
+	for _, pattern := range config.RepositoryExcludePatterns {
+		conditions = append(conditions, celNot(celMatches("attribute.repository", repositoryNameRegexp(pattern))))
+	}
+
+	return celAnd(conditions...)
+}
+
+// newPipelinePrincipals returns a principal set per trusted repository, in the configured order.
+// With owner-wide trust, a single principal set covers every repository of the owner.
+func newPipelinePrincipals(config *Config, repositories []string, poolName pulumi.StringOutput) []pipelinePrincipal {
+	newPrincipal := func(attribute, value string) pipelinePrincipal {
+		principal := pipelinePrincipal{
+			repository: value,
+			id:         pulumi.Sprintf("principalSet://iam.googleapis.com/%s/attribute.%s/%s", poolName, attribute, value),
+		}
+
+		principal.writeID = principal.id
+		if writeAccessGated(config) {
+			principal.gated = true
+			principal.writeID = pulumi.Sprintf("principalSet://iam.googleapis.com/%s/attribute.repository_access/%s:%s", poolName, value, accessWrite)
+		}
+
+		if len(config.TrustProfiles) > 0 {
+			principal.profiles = newTrustProfilePrincipals(config, principal, value, poolName)
+		}
+
+		return principal
+	}
+
+	if config.TrustOwnerRepositories {
+		// The provider condition filters the repositories, so the principal set can cover the owner
+		return []pipelinePrincipal{newPrincipal("repository_owner_id", config.RepositoryOwnerID)}
+	}
+
+	// ALLOWED_REPO_URL is only validated when used, it may be left to its default with ALLOWED_REPO_URLS
+	legacyRepository, err := extractRepoName(config.AllowedRepoURL, config.githubServerHost())
+	if err != nil {
+		legacyRepository = ""
+	}
+
+	principals := make([]pipelinePrincipal, 0, len(repositories))
+
+	for _, repository := range repositories {
+		principal := newPrincipal("repository", repository)
+
+		if repository != legacyRepository {
+			principal.key = memberKey(repository)
+		}
+
+		principals = append(principals, principal)
+	}
+
+	return principals
+}
+
+// validatePrincipalKeys rejects principals of different providers whose binding names would collide,
+// e.g. the GitHub repository gitlab/123 and the GitLab project 123
+func validatePrincipalKeys(principals []pipelinePrincipal) error {
+	keys := map[string]string{}
+
+	for _, principal := range principals {
+		if other, ok := keys[principal.key]; ok {
+			return fmt.Errorf("%q and %q can't both be trusted, their IAM binding names would collide", other, principal.repository)
+		}
+
+		keys[principal.key] = principal.repository
+	}
+
+	return nil
+}
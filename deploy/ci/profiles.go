@@ -0,0 +1,244 @@
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// noTrustProfile is the trust profile of the workflows that match none of the configured ones
+const noTrustProfile = "none"
+
+var (
+	trustProfileNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,30}$`)
+	// Predefined roles (roles/...) and custom roles (projects/*/roles/... or organizations/*/roles/...)
+	iamRolePattern = regexp.MustCompile(`^(roles|(projects|organizations)/[A-Za-z0-9_.:-]+/roles)/[A-Za-z0-9_.]+$`)
+	// GitHub event names, e.g. push or pull_request_target
+	eventNamePattern = regexp.MustCompile(`^[a-z_]+$`)
+	// owner/repo/.github/workflows/file.yml@ref, where any part but the workflows directory may contain wildcards
+	workflowRefPattern = regexp.MustCompile(`^[A-Za-z0-9_.*-]+/[A-Za-z0-9_.*-]+/\.github/workflows/[A-Za-z0-9_./*-]+@[A-Za-z0-9._/*+-]+$`)
+)
+
+// TrustProfileSpec grants roles to the GitHub workflows matching every one of its conditions. Conditions
+// are optional, a profile without any matches every workflow. Refs and workflow refs accept * wildcards.
+type TrustProfileSpec struct {
+	Name string `json:"name"`
+	// Git refs, e.g. refs/tags/v*
+	Refs []string `json:"refs,omitempty"`
+	// branch or tag
+	RefTypes []string `json:"refTypes,omitempty"`
+	// workflow_ref claims, e.g. my-org/my-repo/.github/workflows/release.yml@refs/tags/*
+	WorkflowRefs []string `json:"workflowRefs,omitempty"`
+	// Events triggering the workflow, e.g. push or pull_request
+	Events []string `json:"events,omitempty"`
+	// Deployment environments, e.g. production
+	Environments []string `json:"environments,omitempty"`
+	// Roles on the repositories the pipeline can push to. Tiers the pipeline can only read from are limited to reader.
+	RepositoryRoles []string `json:"repositoryRoles,omitempty"`
+	ProjectRoles    []string `json:"projectRoles,omitempty"`
+	// Roles on the SBOM bucket
+	BucketRoles []string `json:"bucketRoles,omitempty"`
+}
+
+// TrustProfileSpecs is a list of trust profiles, decoded from a JSON array when loaded from the environment
+type TrustProfileSpecs []TrustProfileSpec
+
+// Decode implements envconfig.Decoder
+func (s *TrustProfileSpecs) Decode(value string) error {
+	return json.Unmarshal([]byte(value), (*[]TrustProfileSpec)(s))
+}
+
+// validateTrustProfiles checks the trust profiles. They replace the default pipeline roles and the push restrictions.
+func validateTrustProfiles(config *Config) error {
+	if len(config.TrustProfiles) == 0 {
+		return nil
+	}
+
+	if writeAccessGated(config) {
+		return fmt.Errorf("TRUST_PROFILES can't be combined with ALLOWED_REFS, ALLOWED_REF_TYPES, ALLOWED_REUSABLE_WORKFLOWS or ALLOWED_ENVIRONMENTS")
+	}
+
+	seen := map[string]bool{}
+
+	for i, profile := range config.TrustProfiles {
+		if !trustProfileNamePattern.MatchString(profile.Name) || profile.Name == noTrustProfile {
+			return fmt.Errorf("trust profile name %q must start with a letter and contain only lowercase letters, digits and hyphens, and can't be %q", profile.Name, noTrustProfile)
+		}
+
+		if seen[profile.Name] {
+			return fmt.Errorf("trust profile %q is configured more than once", profile.Name)
+		}
+
+		seen[profile.Name] = true
+
+		err := validateTrustProfile(profile)
+		if err != nil {
+			return fmt.Errorf("trust profile %q: %w", profile.Name, err)
+		}
+
+		// Workflows get the first matching profile, the ones after a catch-all would never match
+		if i < len(config.TrustProfiles)-1 && profile.matchesAny() {
+			return fmt.Errorf("trust profile %q has no condition and must be the last one", profile.Name)
+		}
+	}
+
+	_, err := validateCELSyntax(trustProfileMapping(config))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func validateTrustProfile(profile TrustProfileSpec) error {
+	for _, ref := range profile.Refs {
+		if !refPattern.MatchString(ref) {
+			return fmt.Errorf("ref %q must be a full git ref (e.g. refs/heads/main or refs/tags/v*)", ref)
+		}
+	}
+
+	for _, refType := range profile.RefTypes {
+		if refType != "branch" && refType != "tag" {
+			return fmt.Errorf("ref type %q must be one of: branch, tag", refType)
+		}
+	}
+
+	for _, workflowRef := range profile.WorkflowRefs {
+		if !workflowRefPattern.MatchString(workflowRef) {
+			return fmt.Errorf("workflow ref %q must be a workflow reference (e.g. my-org/my-repo/.github/workflows/release.yml@refs/tags/*)", workflowRef)
+		}
+	}
+
+	for _, event := range profile.Events {
+		if !eventNamePattern.MatchString(event) {
+			return fmt.Errorf("event %q must be a GitHub event name (e.g. push or pull_request)", event)
+		}
+	}
+
+	for _, environment := range profile.Environments {
+		if !environmentNamePattern.MatchString(environment) {
+			return fmt.Errorf("environment %q may only contain letters, digits, spaces, '.', '_' and '-'", environment)
+		}
+	}
+
+	if len(profile.RepositoryRoles)+len(profile.ProjectRoles)+len(profile.BucketRoles) == 0 {
+		return fmt.Errorf("at least one repository, project or bucket role is required")
+	}
+
+	for _, role := range append(append(append([]string{}, profile.RepositoryRoles...), profile.ProjectRoles...), profile.BucketRoles...) {
+		if !iamRolePattern.MatchString(role) {
+			return fmt.Errorf("role %q must be a predefined (roles/...) or custom role", role)
+		}
+	}
+
+	return nil
+}
+
+// matchesAny reports whether the profile has no condition
+func (p TrustProfileSpec) matchesAny() bool {
+	return len(p.Refs)+len(p.RefTypes)+len(p.WorkflowRefs)+len(p.Events)+len(p.Environments) == 0
+}
+
+// condition returns the CEL expression, evaluated on the token claims, a workflow must satisfy to get the profile
+func (p TrustProfileSpec) condition() celExpr {
+	conditions := []celExpr{
+		claimMatchAny("ref", p.Refs),
+		claimMatchAny("ref_type", p.RefTypes),
+		claimMatchAny("workflow_ref", p.WorkflowRefs),
+		claimMatchAny("event_name", p.Events),
+	}
+
+	if len(p.Environments) > 0 {
+		// The environment claim is only present for jobs deploying to an environment
+		conditions = append(conditions, celAnd(celHas("assertion.environment"), celIn("assertion.environment", p.Environments)))
+	}
+
+	return celAnd(conditions...)
+}
+
+// repositoryRoles returns the roles of the profile on a repository where the pipeline has the given role
+func (p TrustProfileSpec) repositoryRoles(pipelineRole string) []string {
+	switch {
+	case pipelineRole == "roles/artifactregistry.writer":
+		return p.RepositoryRoles
+	case pipelineRole != "" && len(p.RepositoryRoles) > 0:
+		return []string{pipelineRole}
+	default:
+		return nil
+	}
+}
+
+// pullPrincipals returns the principals granted pull access on the remote caches and the virtual repository.
+// With trust profiles, only the profiles with repository roles can pull, the workflows matching none get nothing.
+func pullPrincipals(principals []pipelinePrincipal) []pipelinePrincipal {
+	pulling := make([]pipelinePrincipal, 0, len(principals))
+
+	for _, principal := range principals {
+		if len(principal.profiles) == 0 {
+			pulling = append(pulling, principal)
+
+			continue
+		}
+
+		for _, profile := range principal.profiles {
+			if len(profile.profile.RepositoryRoles) > 0 {
+				pulling = append(pulling, profile)
+			}
+		}
+	}
+
+	return pulling
+}
+
+// trustProfileMapping returns the attribute mapping combining the principal scope, as for
+// attribute.repository_access, with the first trust profile matched by the workflow, e.g. my-org/my-repo:release
+func trustProfileMapping(config *Config) string {
+	scope := "assertion.repository"
+	if config.TrustOwnerRepositories {
+		scope = "assertion.repository_owner_id"
+	}
+
+	profile := celString(noTrustProfile)
+
+	// Nested conditionals, from the last profile to the first so the first match wins
+	for i := len(config.TrustProfiles) - 1; i >= 0; i-- {
+		spec := config.TrustProfiles[i]
+		if spec.matchesAny() {
+			profile = celString(spec.Name)
+
+			continue
+		}
+
+		profile = fmt.Sprintf("(%s ? %s : %s)", spec.condition(), celString(spec.Name), profile)
+	}
+
+	return fmt.Sprintf(`%s + ":" + %s`, scope, profile)
+}
+
+// newTrustProfilePrincipals returns the principal set of each trust profile of a principal
+func newTrustProfilePrincipals(config *Config, principal pipelinePrincipal, value string, poolName pulumi.StringOutput) []pipelinePrincipal {
+	profiles := make([]pipelinePrincipal, 0, len(config.TrustProfiles))
+
+	for i := range config.TrustProfiles {
+		spec := &config.TrustProfiles[i]
+
+		key := spec.Name
+		if principal.key != "" {
+			key = fmt.Sprintf("%s-%s", principal.key, spec.Name)
+		}
+
+		id := pulumi.Sprintf("principalSet://iam.googleapis.com/%s/attribute.trust_profile/%s:%s", poolName, value, spec.Name)
+
+		profiles = append(profiles, pipelinePrincipal{
+			repository: fmt.Sprintf("%s:%s", principal.repository, spec.Name),
+			id:         id,
+			writeID:    id,
+			key:        key,
+			profile:    spec,
+		})
+	}
+
+	return profiles
+}
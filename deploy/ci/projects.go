@@ -0,0 +1,80 @@
+package ci
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/iam"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/organizations"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// identityProject returns the project of the workload identity pool and its providers, GCP_PROJECT by default
+func (c *Config) identityProject() string {
+	if c.IdentityProject != "" {
+		return c.IdentityProject
+	}
+
+	return c.GCPProject
+}
+
+// registryProject returns the project of the repositories and of the pipeline project roles, GCP_PROJECT by default
+func (c *Config) registryProject() string {
+	if c.RegistryProject != "" {
+		return c.RegistryProject
+	}
+
+	return c.GCPProject
+}
+
+// sbomBucketProject returns the project of the SBOM bucket, the registry project by default
+func (c *Config) sbomBucketProject() string {
+	if c.SBOMBucketProject != "" {
+		return c.SBOMBucketProject
+	}
+
+	return c.registryProject()
+}
+
+// projectNumbers are the numeric IDs of the projects the component deploys to
+type projectNumbers struct {
+	identity pulumi.StringOutput
+	registry pulumi.StringOutput
+}
+
+// lookupProjectNumbers looks up the numeric project IDs, required for principals, provider IDs and service agents.
+// Each project is looked up once, the registry project under its original name.
+func (r *GithubGoogleRegistry) lookupProjectNumbers(ctx *pulumi.Context) (*projectNumbers, error) {
+	numbers := map[string]pulumi.StringOutput{}
+
+	lookups := []struct {
+		name    string
+		project string
+	}{
+		{"get-project", r.config.registryProject()},
+		{"get-identity-project", r.config.identityProject()},
+	}
+
+	for _, lookup := range lookups {
+		if _, ok := numbers[lookup.project]; ok {
+			continue
+		}
+
+		project, err := organizations.GetProject(ctx, lookup.name, pulumi.ID(lookup.project), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get numeric ID of project %s: %w", lookup.project, err)
+		}
+
+		numbers[lookup.project] = project.Number
+	}
+
+	return &projectNumbers{
+		identity: numbers[r.config.identityProject()],
+		registry: numbers[r.config.registryProject()],
+	}, nil
+}
+
+// workloadIdentityPoolName returns the full resource name of the pool principals are built from,
+// projects/<number>/locations/global/workloadIdentityPools/<id>, with the number of the identity project
+func workloadIdentityPoolName(identityProjectNumber pulumi.StringOutput, pool *iam.WorkloadIdentityPool) pulumi.StringOutput {
+	return pulumi.Sprintf("projects/%s/locations/global/workloadIdentityPools/%s", identityProjectNumber, pool.WorkloadIdentityPoolId)
+}
@@ -0,0 +1,513 @@
+package ci
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// CI systems whose OIDC tokens can be trusted by the workload identity pool
+const (
+	ProviderGitHub    = "github"
+	ProviderGitLab    = "gitlab"
+	ProviderBitbucket = "bitbucket"
+	ProviderBuildkite = "buildkite"
+	ProviderCircleCI  = "circleci"
+)
+
+const buildkiteIssuerURL = "https://agent.buildkite.com"
+
+var (
+	// Numeric project IDs, which unlike project paths can't be reclaimed by another project after a rename or transfer
+	gitlabProjectIDPattern = regexp.MustCompile(`^[0-9]+$`)
+	// organization/pipeline slugs
+	buildkitePipelinePattern  = regexp.MustCompile(`^[a-z0-9_-]+/[a-z0-9_-]+$`)
+	bitbucketWorkspacePattern = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+	// Bitbucket wraps its UUIDs in braces, CircleCI doesn't
+	uuidPattern = regexp.MustCompile(`^\{?([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})\}?$`)
+)
+
+// identityProvider is a CI system trusted by the workload identity pool. Each provider has its own
+// workload identity pool provider, and its pipelines get their own principal sets.
+type identityProvider interface {
+	// name is the CI_PROVIDERS value of the provider
+	name() string
+	// providerID is the workload identity pool provider ID, 4 to 32 characters
+	providerID() string
+	// ciName is the name of the CI system, e.g. GitLab CI
+	ciName() string
+	oidc() *iam.WorkloadIdentityPoolProviderOidcArgs
+	attributeMapping() pulumi.StringMap
+	attributeCondition() celExpr
+	// principals returns a principal set per trusted pipeline. Principal attributes are shared by
+	// every provider of the pool, so each provider uses its own to keep pipelines apart.
+	principals(poolName pulumi.StringOutput) []pipelinePrincipal
+}
+
+// ciProviders returns the configured CI providers, GitHub when none is
+func (c *Config) ciProviders() []string {
+	if len(c.CIProviders) == 0 {
+		return []string{ProviderGitHub}
+	}
+
+	return c.CIProviders
+}
+
+// identityProviders validates the settings of the configured CI providers and returns them in order
+func identityProviders(config *Config) ([]identityProvider, error) {
+	providers := make([]identityProvider, 0, len(config.ciProviders()))
+	seen := map[string]bool{}
+
+	for _, name := range config.ciProviders() {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if seen[name] {
+			return nil, fmt.Errorf("CI provider %q is configured more than once", name)
+		}
+
+		seen[name] = true
+
+		provider, err := newIdentityProvider(config, name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s provider: %w", name, err)
+		}
+
+		// Conditions are built from configuration values, never deploy one that would trust more than configured
+		err = validateAttributeCondition(provider.attributeCondition())
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s provider: %w", name, err)
+		}
+
+		providers = append(providers, provider)
+	}
+
+	// Push restrictions, owner-wide trust and promotions are built on GitHub claims
+	if !seen[ProviderGitHub] && (writeAccessGated(config) || config.TrustOwnerRepositories || len(config.TrustProfiles) > 0 ||
+		len(config.EnvironmentTiers) > 0) {
+		return nil, fmt.Errorf("push restrictions, TRUST_OWNER_REPOSITORIES, TRUST_PROFILES and ENVIRONMENT_TIERS require the %s provider", ProviderGitHub)
+	}
+
+	// The pipelines of the other providers can't be matched against push restrictions, they would push unrestricted
+	if writeAccessGated(config) {
+		for _, provider := range providers {
+			if provider.name() != ProviderGitHub {
+				return nil, fmt.Errorf("push restrictions can't be combined with the %s provider, only %s workflows can be restricted",
+					provider.name(), ProviderGitHub)
+			}
+		}
+	}
+
+	return providers, nil
+}
+
+func newIdentityProvider(config *Config, name string) (identityProvider, error) {
+	switch name {
+	case ProviderGitHub:
+		repositories, err := allowedRepositories(config)
+		if err != nil {
+			return nil, err
+		}
+
+		return &githubProvider{config: config, repositories: repositories}, nil
+	case ProviderGitLab:
+		return newGitLabProvider(config)
+	case ProviderBitbucket:
+		return newBitbucketProvider(config)
+	case ProviderBuildkite:
+		return newBuildkiteProvider(config)
+	case ProviderCircleCI:
+		return newCircleCIProvider(config)
+	default:
+		return nil, fmt.Errorf("unknown CI provider, must be one of: %s, %s, %s, %s, %s",
+			ProviderGitHub, ProviderGitLab, ProviderBitbucket, ProviderBuildkite, ProviderCircleCI)
+	}
+}
+
+// newProviderPrincipal returns the principal set of the pipelines of a provider with the given attribute value.
+// Its key is prefixed with the provider, GitHub repositories with the same key are rejected by validatePrincipalKeys.
+func newProviderPrincipal(provider, attribute, value string, poolName pulumi.StringOutput) pipelinePrincipal {
+	id := pulumi.Sprintf("principalSet://iam.googleapis.com/%s/attribute.%s/%s", poolName, attribute, value)
+
+	return pipelinePrincipal{
+		repository: fmt.Sprintf("%s:%s", provider, value),
+		id:         id,
+		writeID:    id,
+		key:        fmt.Sprintf("%s-%s", provider, memberKey(value)),
+	}
+}
+
+// defaultProviderID returns the provider ID of the providers other than GitHub, e.g. ci-gitlab-provider
+func defaultProviderID(config *Config, name string) string {
+	return capToMax(fmt.Sprintf("%s-%s-provider", config.ResourcePrefix, name), 32)
+}
+
+// githubProvider trusts GitHub Actions workflows of the allowed repositories
+type githubProvider struct {
+	config *Config
+	// owner/repo names, nil with owner-wide trust
+	repositories []string
+}
+
+func (p *githubProvider) name() string { return ProviderGitHub }
+
+func (p *githubProvider) providerID() string {
+	return capToMax(fmt.Sprintf("%s-%s", p.config.ResourcePrefix, p.config.IdentityPoolProviderName), 32)
+}
+
+func (p *githubProvider) ciName() string { return "GitHub Actions" }
+
+func (p *githubProvider) oidc() *iam.WorkloadIdentityPoolProviderOidcArgs {
+	oidc := &iam.WorkloadIdentityPoolProviderOidcArgs{
+		IssuerUri: pulumi.String(p.config.oidcIssuerURL()),
+	}
+
+	// GitHub Enterprise Server is often unreachable from Google, the keys are uploaded instead of fetched from the issuer
+	if p.config.OIDCJwksJSON != "" {
+		oidc.JwksJson = pulumi.String(p.config.OIDCJwksJSON)
+	}
+
+	// Custom audiences replace the default one, the provider resource name
+	if len(p.config.AllowedAudiences) > 0 {
+		oidc.AllowedAudiences = pulumi.ToStringArray(p.config.AllowedAudiences)
+	}
+
+	return oidc
+}
+
+func (p *githubProvider) attributeMapping() pulumi.StringMap {
+	attributeMapping := pulumi.StringMap{
+		"google.subject":                pulumi.String("assertion.sub"),
+		"attribute.repository":          pulumi.String("assertion.repository"),
+		"attribute.repository_owner":    pulumi.String("assertion.repository_owner"),
+		"attribute.repository_owner_id": pulumi.String("assertion.repository_owner_id"),
+		"attribute.repository_id":       pulumi.String("assertion.repository_id"),
+		"attribute.actor":               pulumi.String("assertion.actor"),
+		"attribute.ref":                 pulumi.String("assertion.ref"),
+		"attribute.ref_type":            pulumi.String("assertion.ref_type"),
+		"attribute.sha":                 pulumi.String("assertion.sha"),
+		"attribute.workflow":            pulumi.String("assertion.workflow"),
+		"attribute.workflow_ref":        pulumi.String("assertion.workflow_ref"),
+		"attribute.job_workflow_ref":    pulumi.String("assertion.job_workflow_ref"),
+		"attribute.job_workflow_sha":    pulumi.String("assertion.job_workflow_sha"),
+		"attribute.head_ref":            pulumi.String("assertion.head_ref"),
+		"attribute.base_ref":            pulumi.String("assertion.base_ref"),
+		"attribute.aud":                 pulumi.String("assertion.aud"),
+	}
+
+	// Tells apart the workflows allowed to push from the read-only ones, e.g. my-org/my-repo:write
+	if writeAccessGated(p.config) {
+		attributeMapping["attribute.repository_access"] = pulumi.String(repositoryAccessMapping(p.config))
+	}
+
+	// Tells apart the workflows of each trust profile, e.g. my-org/my-repo:release
+	if len(p.config.TrustProfiles) > 0 {
+		attributeMapping["attribute.trust_profile"] = pulumi.String(trustProfileMapping(p.config))
+	}
+
+	return attributeMapping
+}
+
+func (p *githubProvider) attributeCondition() celExpr {
+	condition := buildAttributeCondition(p.repositories, p.config)
+
+	// The provider already rejects other audiences, checking them in the condition keeps it self-contained
+	if p.config.EnforceAudience {
+		condition = celAnd(condition, celAnyOf("attribute.aud", p.config.AllowedAudiences))
+	}
+
+	return condition
+}
+
+func (p *githubProvider) principals(poolName pulumi.StringOutput) []pipelinePrincipal {
+	return newPipelinePrincipals(p.config, p.repositories, poolName)
+}
+
+// gitlabProvider trusts GitLab CI pipelines of the allowed projects, on gitlab.com or a self-managed instance
+type gitlabProvider struct {
+	config *Config
+	// numeric project IDs
+	projects []string
+}
+
+func newGitLabProvider(config *Config) (*gitlabProvider, error) {
+	gitlabURL, err := url.Parse(config.gitlabURL())
+	if err != nil || gitlabURL.Scheme != "https" || gitlabURL.Host == "" {
+		return nil, fmt.Errorf("GITLAB_URL must be an https URL, got %q", config.GitLabURL)
+	}
+
+	if len(config.GitLabProjectIDs) == 0 {
+		return nil, fmt.Errorf("GITLAB_PROJECT_IDS is required")
+	}
+
+	for _, projectID := range config.GitLabProjectIDs {
+		if !gitlabProjectIDPattern.MatchString(projectID) {
+			return nil, fmt.Errorf("project ID %q must be the numeric ID of the project, shown in its settings", projectID)
+		}
+	}
+
+	return &gitlabProvider{config: config, projects: config.GitLabProjectIDs}, nil
+}
+
+// gitlabURL returns the GitLab instance, which is also the issuer of its tokens
+func (c *Config) gitlabURL() string {
+	if c.GitLabURL == "" {
+		return "https://gitlab.com"
+	}
+
+	return strings.TrimSuffix(c.GitLabURL, "/")
+}
+
+func (p *gitlabProvider) name() string { return ProviderGitLab }
+
+func (p *gitlabProvider) providerID() string { return defaultProviderID(p.config, ProviderGitLab) }
+
+func (p *gitlabProvider) ciName() string { return "GitLab CI" }
+
+func (p *gitlabProvider) oidc() *iam.WorkloadIdentityPoolProviderOidcArgs {
+	return &iam.WorkloadIdentityPoolProviderOidcArgs{
+		IssuerUri: pulumi.String(p.config.gitlabURL()),
+	}
+}
+
+func (p *gitlabProvider) attributeMapping() pulumi.StringMap {
+	return pulumi.StringMap{
+		"google.subject": pulumi.String("assertion.sub"),
+		// CircleCI maps attribute.project_id, GitLab project IDs get their own attribute
+		"attribute.gitlab_project_id": pulumi.String("assertion.project_id"),
+		"attribute.project_path":      pulumi.String("assertion.project_path"),
+		"attribute.namespace_path":    pulumi.String("assertion.namespace_path"),
+		"attribute.namespace_id":      pulumi.String("assertion.namespace_id"),
+		"attribute.ref":               pulumi.String("assertion.ref"),
+		"attribute.ref_type":          pulumi.String("assertion.ref_type"),
+		"attribute.ref_protected":     pulumi.String("assertion.ref_protected"),
+		"attribute.pipeline_source":   pulumi.String("assertion.pipeline_source"),
+		"attribute.user_login":        pulumi.String("assertion.user_login"),
+	}
+}
+
+func (p *gitlabProvider) attributeCondition() celExpr {
+	return celAnyOf("attribute.gitlab_project_id", p.projects)
+}
+
+func (p *gitlabProvider) principals(poolName pulumi.StringOutput) []pipelinePrincipal {
+	principals := make([]pipelinePrincipal, 0, len(p.projects))
+	for _, project := range p.projects {
+		principals = append(principals, newProviderPrincipal(ProviderGitLab, "gitlab_project_id", project, poolName))
+	}
+
+	return principals
+}
+
+// bitbucketProvider trusts Bitbucket Pipelines of the allowed repositories of a workspace
+type bitbucketProvider struct {
+	config *Config
+	// {uuid}, as found in the tokens
+	workspaceUUID string
+	repositories  []string
+}
+
+func newBitbucketProvider(config *Config) (*bitbucketProvider, error) {
+	if !bitbucketWorkspacePattern.MatchString(config.BitbucketWorkspace) {
+		return nil, fmt.Errorf("BITBUCKET_WORKSPACE must be a workspace slug, got %q", config.BitbucketWorkspace)
+	}
+
+	workspaceUUID, err := bitbucketUUID(config.BitbucketWorkspaceUUID)
+	if err != nil {
+		return nil, fmt.Errorf("BITBUCKET_WORKSPACE_UUID %w", err)
+	}
+
+	if len(config.BitbucketRepositoryUUIDs) == 0 {
+		return nil, fmt.Errorf("BITBUCKET_REPOSITORY_UUIDS is required")
+	}
+
+	repositories := make([]string, 0, len(config.BitbucketRepositoryUUIDs))
+
+	for _, repositoryUUID := range config.BitbucketRepositoryUUIDs {
+		repository, err := bitbucketUUID(repositoryUUID)
+		if err != nil {
+			return nil, fmt.Errorf("repository UUID %w", err)
+		}
+
+		repositories = append(repositories, repository)
+	}
+
+	return &bitbucketProvider{config: config, workspaceUUID: workspaceUUID, repositories: repositories}, nil
+}
+
+// bitbucketUUID normalizes a UUID to the lower-cased {uuid} form of the Bitbucket tokens
+func bitbucketUUID(value string) (string, error) {
+	matches := uuidPattern.FindStringSubmatch(value)
+	if matches == nil {
+		return "", fmt.Errorf("%q must be a UUID", value)
+	}
+
+	return fmt.Sprintf("{%s}", strings.ToLower(matches[1])), nil
+}
+
+func (p *bitbucketProvider) name() string { return ProviderBitbucket }
+
+func (p *bitbucketProvider) providerID() string {
+	return defaultProviderID(p.config, ProviderBitbucket)
+}
+
+func (p *bitbucketProvider) ciName() string { return "Bitbucket Pipelines" }
+
+func (p *bitbucketProvider) oidc() *iam.WorkloadIdentityPoolProviderOidcArgs {
+	return &iam.WorkloadIdentityPoolProviderOidcArgs{
+		IssuerUri: pulumi.Sprintf("https://api.bitbucket.org/2.0/workspaces/%s/pipelines-config/identity/oidc", p.config.BitbucketWorkspace),
+		// Bitbucket tokens are issued for the workspace, their audience can't be changed
+		AllowedAudiences: pulumi.StringArray{
+			pulumi.Sprintf("ari:cloud:bitbucket::workspace/%s", strings.Trim(p.workspaceUUID, "{}")),
+		},
+	}
+}
+
+func (p *bitbucketProvider) attributeMapping() pulumi.StringMap {
+	return pulumi.StringMap{
+		"google.subject":            pulumi.String("assertion.sub"),
+		"attribute.workspace_uuid":  pulumi.String("assertion.workspaceUuid"),
+		"attribute.repository_uuid": pulumi.String("assertion.repositoryUuid"),
+		"attribute.pipeline_uuid":   pulumi.String("assertion.pipelineUuid"),
+		"attribute.step_uuid":       pulumi.String("assertion.stepUuid"),
+	}
+}
+
+func (p *bitbucketProvider) attributeCondition() celExpr {
+	return celAnd(celEquals("attribute.workspace_uuid", p.workspaceUUID), celAnyOf("attribute.repository_uuid", p.repositories))
+}
+
+func (p *bitbucketProvider) principals(poolName pulumi.StringOutput) []pipelinePrincipal {
+	principals := make([]pipelinePrincipal, 0, len(p.repositories))
+	for _, repository := range p.repositories {
+		principals = append(principals, newProviderPrincipal(ProviderBitbucket, "repository_uuid", repository, poolName))
+	}
+
+	return principals
+}
+
+// buildkiteProvider trusts Buildkite pipelines, identified by organization/pipeline slugs
+type buildkiteProvider struct {
+	config    *Config
+	pipelines []string
+}
+
+func newBuildkiteProvider(config *Config) (*buildkiteProvider, error) {
+	if len(config.BuildkitePipelines) == 0 {
+		return nil, fmt.Errorf("BUILDKITE_PIPELINES is required")
+	}
+
+	for _, pipeline := range config.BuildkitePipelines {
+		if !buildkitePipelinePattern.MatchString(pipeline) {
+			return nil, fmt.Errorf("pipeline %q must be an organization and a pipeline slug (e.g. my-org/my-pipeline)", pipeline)
+		}
+	}
+
+	return &buildkiteProvider{config: config, pipelines: config.BuildkitePipelines}, nil
+}
+
+func (p *buildkiteProvider) name() string { return ProviderBuildkite }
+
+func (p *buildkiteProvider) providerID() string {
+	return defaultProviderID(p.config, ProviderBuildkite)
+}
+
+func (p *buildkiteProvider) ciName() string { return "Buildkite" }
+
+func (p *buildkiteProvider) oidc() *iam.WorkloadIdentityPoolProviderOidcArgs {
+	return &iam.WorkloadIdentityPoolProviderOidcArgs{
+		IssuerUri: pulumi.String(buildkiteIssuerURL),
+	}
+}
+
+func (p *buildkiteProvider) attributeMapping() pulumi.StringMap {
+	return pulumi.StringMap{
+		// The sub claim includes the commit and step, and can exceed the 127 bytes allowed for the subject
+		"google.subject":              pulumi.String(`assertion.organization_slug + ":" + assertion.pipeline_slug + ":" + string(assertion.build_number)`),
+		"attribute.pipeline":          pulumi.String(`assertion.organization_slug + "/" + assertion.pipeline_slug`),
+		"attribute.organization_slug": pulumi.String("assertion.organization_slug"),
+		"attribute.pipeline_slug":     pulumi.String("assertion.pipeline_slug"),
+		"attribute.build_branch":      pulumi.String("assertion.build_branch"),
+		"attribute.build_commit":      pulumi.String("assertion.build_commit"),
+	}
+}
+
+func (p *buildkiteProvider) attributeCondition() celExpr {
+	return celAnyOf("attribute.pipeline", p.pipelines)
+}
+
+func (p *buildkiteProvider) principals(poolName pulumi.StringOutput) []pipelinePrincipal {
+	principals := make([]pipelinePrincipal, 0, len(p.pipelines))
+	for _, pipeline := range p.pipelines {
+		principals = append(principals, newProviderPrincipal(ProviderBuildkite, "pipeline", pipeline, poolName))
+	}
+
+	return principals
+}
+
+// circleCIProvider trusts CircleCI projects of an organization
+type circleCIProvider struct {
+	config   *Config
+	orgID    string
+	projects []string
+}
+
+func newCircleCIProvider(config *Config) (*circleCIProvider, error) {
+	matches := uuidPattern.FindStringSubmatch(config.CircleCIOrgID)
+	if matches == nil || strings.HasPrefix(config.CircleCIOrgID, "{") {
+		return nil, fmt.Errorf("CIRCLECI_ORG_ID must be the organization UUID, got %q", config.CircleCIOrgID)
+	}
+
+	if len(config.CircleCIProjectIDs) == 0 {
+		return nil, fmt.Errorf("CIRCLECI_PROJECT_IDS is required")
+	}
+
+	projects := make([]string, 0, len(config.CircleCIProjectIDs))
+
+	for _, projectID := range config.CircleCIProjectIDs {
+		projectMatches := uuidPattern.FindStringSubmatch(projectID)
+		if projectMatches == nil || strings.HasPrefix(projectID, "{") {
+			return nil, fmt.Errorf("project ID %q must be a UUID", projectID)
+		}
+
+		projects = append(projects, strings.ToLower(projectMatches[1]))
+	}
+
+	return &circleCIProvider{config: config, orgID: strings.ToLower(matches[1]), projects: projects}, nil
+}
+
+func (p *circleCIProvider) name() string { return ProviderCircleCI }
+
+func (p *circleCIProvider) providerID() string { return defaultProviderID(p.config, ProviderCircleCI) }
+
+func (p *circleCIProvider) ciName() string { return "CircleCI" }
+
+func (p *circleCIProvider) oidc() *iam.WorkloadIdentityPoolProviderOidcArgs {
+	return &iam.WorkloadIdentityPoolProviderOidcArgs{
+		IssuerUri: pulumi.Sprintf("https://oidc.circleci.com/org/%s", p.orgID),
+		// CircleCI tokens are issued for the organization ID
+		AllowedAudiences: pulumi.StringArray{pulumi.String(p.orgID)},
+	}
+}
+
+func (p *circleCIProvider) attributeMapping() pulumi.StringMap {
+	return pulumi.StringMap{
+		"google.subject":       pulumi.String("assertion.sub"),
+		"attribute.project_id": pulumi.String(`assertion["oidc.circleci.com/project-id"]`),
+	}
+}
+
+func (p *circleCIProvider) attributeCondition() celExpr {
+	return celAnyOf("attribute.project_id", p.projects)
+}
+
+func (p *circleCIProvider) principals(poolName pulumi.StringOutput) []pipelinePrincipal {
+	principals := make([]pipelinePrincipal, 0, len(p.projects))
+	for _, project := range p.projects {
+		principals = append(principals, newProviderPrincipal(ProviderCircleCI, "project_id", project, poolName))
+	}
+
+	return principals
+}
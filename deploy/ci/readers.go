@@ -0,0 +1,159 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// serviceAgentPrefix marks a reader member resolved from a project number, e.g. serviceAgent:cloud-run:123456789012
+const serviceAgentPrefix = "serviceAgent:"
+
+var projectNumberPattern = regexp.MustCompile(`^[0-9]{6,20}$`)
+
+// Service accounts pulling images on behalf of a runtime, keyed by shorthand. The format takes the project number.
+var serviceAgentFormats = map[string]string{
+	// Cloud Run service agent, pulling the images of the services
+	"cloud-run": "service-%s@serverless-robot-prod.iam.gserviceaccount.com",
+	// Cloud Functions service agent
+	"cloud-functions": "service-%s@gcf-admin-robot.iam.gserviceaccount.com",
+	// GKE service agent
+	"gke": "service-%s@container-engine-robot.iam.gserviceaccount.com",
+	// Compute Engine default service account, used by GKE nodes unless they are given their own
+	"compute": "%s-compute@developer.gserviceaccount.com",
+	// Legacy Cloud Build service account
+	"cloud-build": "%s@cloudbuild.gserviceaccount.com",
+}
+
+// resolveReaderMembers returns the IAM members of READER_MEMBERS, with the service agent shorthands resolved
+func resolveReaderMembers(config *Config) ([]string, error) {
+	members := make([]string, 0, len(config.ReaderMembers))
+	seen := map[string]bool{}
+
+	for _, member := range config.ReaderMembers {
+		member = strings.TrimSpace(member)
+
+		if strings.HasPrefix(member, serviceAgentPrefix) {
+			resolved, err := resolveServiceAgent(strings.TrimPrefix(member, serviceAgentPrefix))
+			if err != nil {
+				return nil, err
+			}
+
+			member = resolved
+		} else if !strings.Contains(member, ":") {
+			return nil, fmt.Errorf("reader member %q must be prefixed with its type (e.g. serviceAccount:, group:, principalSet:, serviceAgent:)", member)
+		}
+
+		if seen[member] {
+			return nil, fmt.Errorf("reader member %q is configured more than once", member)
+		}
+
+		seen[member] = true
+
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+// resolveServiceAgent turns an agent:project-number shorthand into the agent's IAM member
+func resolveServiceAgent(shorthand string) (string, error) {
+	agent, projectNumber, found := strings.Cut(shorthand, ":")
+	if !found {
+		return "", fmt.Errorf("service agent %q must be an agent and a project number (e.g. serviceAgent:cloud-run:123456789012)", shorthand)
+	}
+
+	format, ok := serviceAgentFormats[agent]
+	if !ok {
+		return "", fmt.Errorf("unknown service agent %q, must be one of: cloud-run, cloud-functions, gke, compute, cloud-build", agent)
+	}
+
+	if !projectNumberPattern.MatchString(projectNumber) {
+		return "", fmt.Errorf("service agent %q needs the numeric project number, got %q", agent, projectNumber)
+	}
+
+	return "serviceAccount:" + fmt.Sprintf(format, projectNumber), nil
+}
+
+// grantReaderMembers grants the reader members pull access to every managed repository, the remote caches
+// and the virtual repository
+func (r *GithubGoogleRegistry) grantReaderMembers(ctx *pulumi.Context, repositories []*managedRepository, caches []remoteCache) error {
+	members, err := resolveReaderMembers(r.config)
+	if err != nil {
+		return err
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	const role = "roles/artifactregistry.reader"
+
+	type target struct {
+		repository  pulumi.StringInput
+		bindingName func(key string) string
+		// Members already granted access on the repository through its spec
+		granted []string
+	}
+
+	targets := make([]target, 0, len(repositories)+len(caches)+1)
+
+	for _, repository := range repositories {
+		targets = append(targets, target{
+			repository: repository.repository.Name,
+			bindingName: func(key string) string {
+				return repository.iamBindingName(r.config.ResourcePrefix, role, key)
+			},
+			granted: append(append([]string{}, repository.writers...), repository.readers...),
+		})
+	}
+
+	// Remote cache repositories are created in the same order as the configured caches
+	for i, cache := range caches {
+		targets = append(targets, target{
+			repository: r.RemoteCacheRepositories[i].Name,
+			bindingName: func(key string) string {
+				return fmt.Sprintf("%s-%s-cache-iam-%s-%s", r.config.ResourcePrefix, cache.name, role, key)
+			},
+		})
+	}
+
+	if r.VirtualRepository != nil {
+		targets = append(targets, target{
+			repository: r.VirtualRepository.Name,
+			bindingName: func(key string) string {
+				return fmt.Sprintf("%s-virtual-repo-iam-%s-%s", r.config.ResourcePrefix, role, key)
+			},
+		})
+	}
+
+	r.ReaderMembers = members
+	r.ReaderIAMMembers = make([]*artifactregistry.RepositoryIamMember, 0, len(targets)*len(members))
+
+	for _, t := range targets {
+		for _, member := range members {
+			if slices.Contains(t.granted, member) {
+				continue
+			}
+
+			iamMember, err := artifactregistry.NewRepositoryIamMember(ctx, t.bindingName(memberKey(member)), &artifactregistry.RepositoryIamMemberArgs{
+				Repository: t.repository,
+				Location:   pulumi.String(r.config.RepositoryLocation),
+				Project:    pulumi.String(r.config.registryProject()),
+				Role:       pulumi.String(role),
+				Member:     pulumi.String(member),
+			}, pulumi.Parent(r))
+			if err != nil {
+				return fmt.Errorf("failed to create reader IAM member %s: %w", member, err)
+			}
+
+			r.ReaderIAMMembers = append(r.ReaderIAMMembers, iamMember)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Access levels encoded in attribute.repository_access
+const (
+	accessWrite = "write"
+	accessRead  = "read"
+)
+
+var (
+	// Environment names may contain spaces, but no characters that would need escaping in CEL
+	environmentNamePattern = regexp.MustCompile(`^[A-Za-z0-9 ._-]+$`)
+	refPattern             = regexp.MustCompile(`^refs/[A-Za-z0-9._/*+-]+$`)
+	// owner/repo/.github/workflows/file.yml@ref, where the ref may contain wildcards
+	reusableWorkflowPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+/\.github/workflows/[A-Za-z0-9_./-]+\.ya?ml@[A-Za-z0-9._/*+-]+$`)
+)
+
+// writeAccessGated reports whether pushing is restricted to some refs, reusable workflows or environments. Otherwise
+// every trusted workflow can push.
+func writeAccessGated(config *Config) bool {
+	return len(config.AllowedRefs) > 0 || len(config.AllowedRefTypes) > 0 || len(config.AllowedEnvironments) > 0 ||
+		len(config.AllowedReusableWorkflows) > 0
+}
+
+// validateWriteAccess checks the allowed refs, ref types, reusable workflows and environments
+func validateWriteAccess(config *Config) error {
+	for _, ref := range config.AllowedRefs {
+		if !refPattern.MatchString(ref) {
+			return fmt.Errorf("allowed ref %q must be a full git ref (e.g. refs/heads/main or refs/tags/v*)", ref)
+		}
+	}
+
+	for _, refType := range config.AllowedRefTypes {
+		if refType != "branch" && refType != "tag" {
+			return fmt.Errorf("allowed ref type %q must be one of: branch, tag", refType)
+		}
+	}
+
+	for _, workflow := range config.AllowedReusableWorkflows {
+		if !reusableWorkflowPattern.MatchString(workflow) {
+			return fmt.Errorf("allowed reusable workflow %q must be a workflow reference (e.g. my-org/workflows/.github/workflows/build.yml@refs/tags/v2)", workflow)
+		}
+	}
+
+	for _, environment := range config.AllowedEnvironments {
+		if !environmentNamePattern.MatchString(environment) {
+			return fmt.Errorf("allowed environment %q may only contain letters, digits, spaces, '.', '_' and '-'", environment)
+		}
+	}
+
+	if writeAccessGated(config) {
+		_, err := validateCELSyntax(repositoryAccessMapping(config))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// claimMatchExpression returns a CEL expression matching a claim against a value, where * matches anything
+func claimMatchExpression(claim, value string) celExpr {
+	field := "assertion." + claim
+	if !strings.Contains(value, "*") {
+		return celEquals(field, value)
+	}
+
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+
+	return celMatches(field, fmt.Sprintf("^%s$", strings.Join(parts, ".*")))
+}
+
+// claimMatchAny returns a CEL expression matching a claim against any of the values
+func claimMatchAny(claim string, values []string) celExpr {
+	alternatives := make([]celExpr, 0, len(values))
+	for _, value := range values {
+		alternatives = append(alternatives, claimMatchExpression(claim, value))
+	}
+
+	return celOr(alternatives...)
+}
+
+// writeAccessExpression returns the CEL expression, evaluated on the token claims, that a workflow
+// must satisfy to push. Pull request workflows never satisfy it, whatever their ref.
+func writeAccessExpression(config *Config) celExpr {
+	conditions := []celExpr{
+		celNot(celStartsWith("assertion.event_name", "pull_request")),
+		claimMatchAny("ref", config.AllowedRefs),
+		claimMatchAny("ref_type", config.AllowedRefTypes),
+		// The job runs a centrally owned reusable workflow. For jobs that don't call one, job_workflow_ref is the calling workflow.
+		claimMatchAny("job_workflow_ref", config.AllowedReusableWorkflows),
+	}
+
+	if len(config.AllowedEnvironments) > 0 {
+		// The environment claim is only present for jobs deploying to an environment
+		conditions = append(conditions, celAnd(celHas("assertion.environment"), celIn("assertion.environment", config.AllowedEnvironments)))
+	}
+
+	return celAnd(conditions...)
+}
+
+// repositoryAccessMapping returns the attribute mapping combining the principal scope, the repository or
+// with owner-wide trust the owner ID, with the access level of the workflow, e.g. my-org/my-repo:write
+func repositoryAccessMapping(config *Config) string {
+	scope := "assertion.repository"
+	if config.TrustOwnerRepositories {
+		scope = "assertion.repository_owner_id"
+	}
+
+	return fmt.Sprintf(`%s + ":" + (%s ? %s : %s)`, scope, writeAccessExpression(config), celString(accessWrite), celString(accessRead))
+}
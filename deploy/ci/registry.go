@@ -3,11 +3,12 @@ package ci
 
 import (
 	"fmt"
+	"strings"
 
 	namer "github.com/davidmontoyago/commodity-namer"
 	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
 	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/iam"
-	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/organizations"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/kms"
 	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
 	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/serviceaccount"
 	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/storage"
@@ -19,18 +20,74 @@ type GithubGoogleRegistry struct {
 	pulumi.ResourceState
 	namer.Namer
 
-	RegistryURL                 pulumi.StringOutput
-	WorkloadIdentityPool        *iam.WorkloadIdentityPool
-	OidcProvider                *iam.WorkloadIdentityPoolProvider
-	RepositoryPrincipalID       pulumi.StringOutput
+	// URL and format of the primary (first) repository
+	RegistryURL    pulumi.StringOutput
+	RegistryFormat pulumi.StringOutput
+	// URL of every managed repository, keyed by repository name
+	RegistryURLs pulumi.StringMap
+	Repositories map[string]*artifactregistry.Repository
+	// Whether tags can be overwritten, keyed by Docker repository name
+	ImmutableTags pulumi.BoolMap
+	// Whether automatic vulnerability scanning is active, keyed by repository name
+	VulnerabilityScanningStates pulumi.StringMap
+	// URL of each environment tier repository, keyed by tier
+	EnvironmentRegistryURLs pulumi.StringMap
+	WorkloadIdentityPool    *iam.WorkloadIdentityPool
+	// OIDC provider of the first CI provider, GitHub Actions by default
+	OidcProvider *iam.WorkloadIdentityPoolProvider
+	// OIDC provider of every CI provider, keyed by provider name (e.g. github, gitlab)
+	OidcProviders map[string]*iam.WorkloadIdentityPoolProvider
+	// Principal of the first trusted GitHub repository, or pipeline of the first CI provider
+	RepositoryPrincipalID pulumi.StringOutput
+	// Principal of every trusted GitHub repository, keyed by owner/repo. Pipelines of the other
+	// CI providers are keyed by provider and pipeline, e.g. gitlab:my-group/my-project.
+	RepositoryPrincipalIDs pulumi.StringMap
+	// Principal of the workflows allowed to push, keyed by owner/repo. Set when pushes are restricted to some refs or environments.
+	RepositoryWritePrincipalIDs pulumi.StringMap
+	// Principal of the workflows of each trust profile, keyed by owner/repo:profile
+	TrustProfilePrincipalIDs pulumi.StringMap
+	// Principal of the workflow allowed to promote images across environment tiers
+	PromotionPrincipalID        pulumi.StringOutput
 	RepositoryIAMMembers        []*artifactregistry.RepositoryIamMember
 	ProjectIAMMembers           []*projects.IAMMember
 	GitHubActionsServiceAccount *serviceaccount.Account
-	SBOMBucket                  *storage.Bucket
-	SBOMBucketIAMMember         *storage.BucketIAMMember
+	// Workload identity user bindings of the pipeline principals on the service account
+	ServiceAccountIAMMembers []*serviceaccount.IAMMember
+	// How the pipelines authenticate: direct, service-account or both
+	AuthMode   string
+	SBOMBucket *storage.Bucket
+	// Object admin binding of the first trusted repository
+	SBOMBucketIAMMember  *storage.BucketIAMMember
+	SBOMBucketIAMMembers []*storage.BucketIAMMember
+	// Custom role granting SBOM uploads, created in every mode and only bound without the legacy SBOM roles
+	SBOMCustomRole *projects.IAMCustomRole
+
+	// Members with pull access on every repository, with the service agents resolved
+	ReaderMembers    []string
+	ReaderIAMMembers []*artifactregistry.RepositoryIamMember
+
+	// Pull-through caches for upstream registries, keyed by cache name
+	RemoteCacheURLs         pulumi.StringMap
+	RemoteCacheRepositories []*artifactregistry.Repository
+	RemoteCacheIAMMembers   []*artifactregistry.RepositoryIamMember
+
+	// Single pull URL for the registry and its remote caches
+	VirtualRegistryURL          pulumi.StringOutput
+	VirtualRepository           *artifactregistry.Repository
+	VirtualRepositoryIAMMembers []*artifactregistry.RepositoryIamMember
+
+	// Customer-managed encryption keys, unset when Google-managed encryption is used
+	RepositoryKMSKeyName pulumi.StringOutput
+	SBOMBucketKMSKeyName pulumi.StringOutput
+	KMSCryptoKeys        []*kms.CryptoKey
+	KMSKeyIAMMembers     []*kms.CryptoKeyIAMMember
 
 	// This is the resulting workload identity provider that must be passed in the Github auth action call
 	WorkloadIdentityPoolProviderID pulumi.StringOutput
+	// Workload identity provider of every CI provider, keyed by provider name
+	WorkloadIdentityPoolProviderIDs pulumi.StringMap
+	// Audience GitHub Actions tokens must be requested for: the first allowed audience, or the provider resource name
+	ExpectedAudience pulumi.StringOutput
 
 	repositoryName string
 	config         *Config
@@ -38,6 +95,11 @@ type GithubGoogleRegistry struct {
 
 // NewGithubGoogleRegistry creates CI/CD infrastructure for GitHub Actions
 func NewGithubGoogleRegistry(ctx *pulumi.Context, config *Config, opts ...pulumi.ResourceOption) (*GithubGoogleRegistry, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	// Set up Artifact Registry for Docker images
 	registry := &GithubGoogleRegistry{
 		Namer:          namer.New(config.ResourcePrefix, namer.WithReplace()),
@@ -47,7 +109,7 @@ func NewGithubGoogleRegistry(ctx *pulumi.Context, config *Config, opts ...pulumi
 
 	componentName := fmt.Sprintf("%s-%s", config.ResourcePrefix, config.RepositoryName)
 
-	err := ctx.RegisterComponentResource("pulumi-gcp-github-registry:ci:GithubGoogleRegistry", componentName, registry, opts...)
+	err = ctx.RegisterComponentResource("pulumi-gcp-github-registry:ci:GithubGoogleRegistry", componentName, registry, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to register component resource: %w", err)
 	}
@@ -72,181 +134,470 @@ func (r *GithubGoogleRegistry) deploy(ctx *pulumi.Context) error {
 		return fmt.Errorf("failed to enable Container Analysis API: %w", err)
 	}
 
-	repoResourceName := r.NewResourceName(r.repositoryName, "repo", 63)
-	// The input controls the ID, we just make sure it's valid
-	repositoryID := r.NewResourceName(r.repositoryName, "", 63)
+	repositories, err := resolveRepositories(r.config)
+	if err != nil {
+		return err
+	}
 
-	registry, err := artifactregistry.NewRepository(ctx, repoResourceName, &artifactregistry.RepositoryArgs{
-		RepositoryId: pulumi.String(repositoryID),
-		Location:     pulumi.String(r.config.RepositoryLocation),
-		Project:      pulumi.String(r.config.GCPProject),
-		Description:  pulumi.String("CI/CD Docker image registry"),
-		Format:       pulumi.String("DOCKER"),
-		Labels: pulumi.StringMap{
-			"managed-by": pulumi.String("pulumi"),
-			"purpose":    pulumi.String("docker-images"),
-		},
+	remoteCaches, err := parseRemoteCaches(r.config)
+	if err != nil {
+		return err
+	}
 
-		CleanupPolicies: &artifactregistry.RepositoryCleanupPolicyArray{
-			&artifactregistry.RepositoryCleanupPolicyArgs{
-				Id:     pulumi.String("keep-recent-versions"),
-				Action: pulumi.String("KEEP"),
-				MostRecentVersions: &artifactregistry.RepositoryCleanupPolicyMostRecentVersionsArgs{
-					KeepCount: pulumi.Int(r.config.RecentImageRetentionCount), // keep the X most recent versions
-				},
-			},
-			&artifactregistry.RepositoryCleanupPolicyArgs{
-				Id:     pulumi.String("delete-old-versions"),
-				Action: pulumi.String("DELETE"),
-				Condition: &artifactregistry.RepositoryCleanupPolicyConditionArgs{
-					OlderThan: pulumi.String(r.config.OldImageDeletionDays), // delete versions older than configured days
-					TagState:  pulumi.String("ANY"),
-				},
-			},
-		},
-	},
-		pulumi.Parent(r),
-		pulumi.Protect(r.config.ProtectResources),
-		pulumi.DependsOn([]pulumi.Resource{registryAPI}),
-	)
+	// Numeric project IDs are required for principals, provider IDs and service agents
+	projectNumbers, err := r.lookupProjectNumbers(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create artifact registry repository: %w", err)
+		return err
 	}
 
-	repoName := extractRepoName(r.config.AllowedRepoURL)
+	// Create or look up the encryption keys before the resources they encrypt
+	encryption, err := r.deployEncryptionKeys(ctx, registryAPI)
+	if err != nil {
+		return fmt.Errorf("failed to set up encryption keys: %w", err)
+	}
 
-	// Create OIDC provider for GitHub Actions
-	oidcProvider, workloadIdentityPool, err := r.newGithubActionsOIDCProvider(ctx, r.config, repoName)
+	// Enable scanning before the repositories are created so their first artifacts are scanned
+	scanningAPI, err := r.enableVulnerabilityScanning(ctx, repositories)
 	if err != nil {
-		return fmt.Errorf("failed to create OIDC provider for GitHub Actions: %w", err)
+		return err
 	}
 
-	// Create service account and bind it to workload identity pool
-	repoPrincipalID := pulumi.Sprintf(
-		"principalSet://iam.googleapis.com/%s/attribute.repository/%s",
-		workloadIdentityPool.Name,
-		repoName,
-	)
+	repositoryDependencies := append([]pulumi.Resource{registryAPI}, encryption.dependencies...)
+	if scanningAPI != nil {
+		repositoryDependencies = append(repositoryDependencies, scanningAPI)
+	}
 
-	// Grant IAM permissions to the pipeline
-	repoIAMMembers, projectIAMMembers, err := r.grantPipelineIAM(ctx, r.config, registry, repoPrincipalID)
+	for _, repository := range repositories {
+		err = r.deployRepository(ctx, repository, encryption, repositoryDependencies)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The first repository is the primary one, served first by the virtual repository
+	primary := repositories[0]
+
+	providers, err := identityProviders(r.config)
 	if err != nil {
-		return fmt.Errorf("failed to grant IAM permissions to the pipeline: %w", err)
+		return err
 	}
 
-	// Create SBOM bucket for storing Software Bill of Materials
-	sbomBucket, sbomBucketIAMMember, err := r.createSBOMsBucket(ctx, r.config, repoPrincipalID)
+	workloadIdentityPool, err := r.newWorkloadIdentityPool(ctx, r.config)
 	if err != nil {
-		return fmt.Errorf("failed to create SBOM bucket: %w", err)
+		return err
+	}
+
+	// Each CI system gets its own OIDC provider in the pool. Each trusted repository or pipeline gets its own
+	// principal set and bindings, so they can be added and removed without touching the pool, the providers or each other.
+	oidcProviders := make(map[string]*iam.WorkloadIdentityPoolProvider, len(providers))
+	providerIDs := pulumi.StringMap{}
+
+	// Principals are built from the pool name, which holds the number of the identity project
+	poolName := workloadIdentityPoolName(projectNumbers.identity, workloadIdentityPool)
+
+	var principals []pipelinePrincipal
+
+	promotionRepository := ""
+
+	for _, provider := range providers {
+		oidcProvider, err := r.newOIDCProvider(ctx, r.config, workloadIdentityPool, provider)
+		if err != nil {
+			return err
+		}
+
+		oidcProviders[provider.name()] = oidcProvider
+		providerIDs[provider.name()] = pulumi.Sprintf(
+			"%s/providers/%s",
+			poolName,
+			oidcProvider.WorkloadIdentityPoolProviderId,
+		)
+
+		if r.OidcProvider == nil {
+			r.OidcProvider = oidcProvider
+			r.WorkloadIdentityPoolProviderID = providerIDs[provider.name()].ToStringOutput()
+		}
+
+		if github, ok := provider.(*githubProvider); ok {
+			// Relative promotion workflow paths belong to the first trusted repository, owner-wide trust requires qualified ones
+			if len(github.repositories) > 0 {
+				promotionRepository = github.repositories[0]
+			}
+
+			r.ExpectedAudience = pulumi.Sprintf("https://iam.googleapis.com/%s", providerIDs[provider.name()])
+			if len(r.config.AllowedAudiences) > 0 {
+				r.ExpectedAudience = pulumi.String(r.config.AllowedAudiences[0]).ToStringOutput()
+			}
+		}
+
+		principals = append(principals, provider.principals(poolName)...)
+	}
+
+	err = validatePrincipalKeys(principals)
+	if err != nil {
+		return err
+	}
+
+	// Only the promotion workflow can push to the environment tiers above the lowest one
+	promotionPrincipalID := pulumi.Sprintf(
+		"principalSet://iam.googleapis.com/%s/attribute.workflow_ref/%s",
+		poolName,
+		promotionWorkflowRef(r.config, promotionRepository),
+	)
+
+	// The pipeline roles go to the principals, to the service account they impersonate, or to both
+	var grantees []pipelinePrincipal
+	if r.config.grantsDirectAccess() {
+		grantees = append(grantees, principals...)
 	}
 
 	var githubActionsSA *serviceaccount.Account
-	if r.config.CreateServiceAccount {
-		githubActionsSA, err = r.newServiceAccountForDelegation(ctx, r.config)
+	if r.config.usesServiceAccount() {
+		githubActionsSA, err = r.newServiceAccountForDelegation(ctx, r.config, principals)
 		if err != nil {
 			return fmt.Errorf("failed to create service account for delegation: %w", err)
 		}
+
+		grantees = append(grantees, newServiceAccountPrincipal(githubActionsSA))
 	}
 
-	// Create the registry URL
-	registryURL := pulumi.Sprintf("%s-docker.pkg.dev/%s/%s", pulumi.String(r.config.RepositoryLocation), pulumi.String(r.config.GCPProject), registry.RepositoryId)
+	err = r.newSBOMCustomRole(ctx)
+	if err != nil {
+		return err
+	}
 
-	// Create the workload identity provider ID to set in the Github auth action
-	// Numeric project ID is required
-	project, err := organizations.GetProject(ctx, "get-project", pulumi.ID(r.config.GCPProject), nil)
+	// Grant IAM permissions to the pipeline
+	repoIAMMembers, projectIAMMembers, err := r.grantPipelineIAM(ctx, r.config, repositories, grantees, promotionPrincipalID)
 	if err != nil {
-		return fmt.Errorf("failed to get project numeric ID: %w", err)
+		return fmt.Errorf("failed to grant IAM permissions to the pipeline: %w", err)
 	}
 
-	workloadIdentityPoolProviderID := pulumi.Sprintf(
-		"projects/%s/locations/global/workloadIdentityPools/%s/providers/%s",
-		project.Number,
-		workloadIdentityPool.WorkloadIdentityPoolId,
-		oidcProvider.WorkloadIdentityPoolProviderId,
-	)
+	// Create pull-through caches for upstream registries
+	err = r.deployRemoteCaches(ctx, remoteCaches, projectNumbers.registry, grantees, encryption, repositoryDependencies)
+	if err != nil {
+		return fmt.Errorf("failed to create remote caches: %w", err)
+	}
+
+	// Aggregate the registry and the caches behind a single URL
+	err = r.deployVirtualRepository(ctx, primary, remoteCaches, grantees, registryAPI)
+	if err != nil {
+		return fmt.Errorf("failed to create virtual repository: %w", err)
+	}
+
+	// Pull access for the runtimes and other consumers of the images
+	err = r.grantReaderMembers(ctx, repositories, remoteCaches)
+	if err != nil {
+		return fmt.Errorf("failed to grant access to the reader members: %w", err)
+	}
+
+	// Create SBOM bucket for storing Software Bill of Materials
+	sbomBucket, sbomBucketIAMMembers, err := r.createSBOMsBucket(ctx, r.config, grantees, encryption)
+	if err != nil {
+		return fmt.Errorf("failed to create SBOM bucket: %w", err)
+	}
+
+	// Create the registry URLs for each repository format
+	registryURLs := pulumi.StringMap{}
+	immutableTags := pulumi.BoolMap{}
+	scanningStates := pulumi.StringMap{}
+	r.Repositories = make(map[string]*artifactregistry.Repository, len(repositories))
+
+	for _, repository := range repositories {
+		registryURLs[repository.name] = repository.url(r.config)
+		r.Repositories[repository.name] = repository.repository
+		// Reported by Artifact Registry: SCANNING_ACTIVE, SCANNING_DISABLED or SCANNING_UNSUPPORTED
+		scanningStates[repository.name] = repository.repository.VulnerabilityScanningConfig.EnablementState().Elem()
+
+		if repository.format.name == FormatDocker {
+			immutableTags[repository.name] = pulumi.Bool(repository.immutableTags)
+		}
+	}
+
+	repositoryPrincipalIDs := pulumi.StringMap{}
+	for _, principal := range principals {
+		repositoryPrincipalIDs[principal.repository] = principal.id
+	}
 
 	// Set the outputs
-	r.RegistryURL = registryURL
-	r.WorkloadIdentityPoolProviderID = workloadIdentityPoolProviderID
-	r.RepositoryPrincipalID = repoPrincipalID
+	r.RegistryURL = primary.url(r.config)
+	r.RegistryFormat = primary.repository.Format
+	r.RegistryURLs = registryURLs
+	r.ImmutableTags = immutableTags
+	r.VulnerabilityScanningStates = scanningStates
+	r.WorkloadIdentityPoolProviderIDs = providerIDs
+	r.RepositoryPrincipalID = principals[0].id
+	r.RepositoryPrincipalIDs = repositoryPrincipalIDs
+
+	if writeAccessGated(r.config) {
+		r.RepositoryWritePrincipalIDs = pulumi.StringMap{}
+
+		for _, principal := range principals {
+			if principal.gated {
+				r.RepositoryWritePrincipalIDs[principal.repository] = principal.writeID
+			}
+		}
+	}
 	r.RepositoryIAMMembers = repoIAMMembers
 	r.ProjectIAMMembers = projectIAMMembers
 	r.WorkloadIdentityPool = workloadIdentityPool
-	r.OidcProvider = oidcProvider
+	r.OidcProviders = oidcProviders
 	r.GitHubActionsServiceAccount = githubActionsSA
+	r.AuthMode = r.config.AuthMode
 	r.SBOMBucket = sbomBucket
-	r.SBOMBucketIAMMember = sbomBucketIAMMember
+	r.SBOMBucketIAMMembers = sbomBucketIAMMembers
+
+	// Trust profiles may not grant any bucket role
+	if len(sbomBucketIAMMembers) > 0 {
+		r.SBOMBucketIAMMember = sbomBucketIAMMembers[0]
+	}
+
+	if len(r.config.TrustProfiles) > 0 {
+		r.TrustProfilePrincipalIDs = pulumi.StringMap{}
+
+		for _, principal := range principals {
+			for _, profile := range principal.profiles {
+				r.TrustProfilePrincipalIDs[profile.repository] = profile.id
+			}
+		}
+	}
+
+	if len(r.config.EnvironmentTiers) > 0 {
+		r.PromotionPrincipalID = promotionPrincipalID
+		r.EnvironmentRegistryURLs = pulumi.StringMap{}
+
+		for _, repository := range repositories {
+			if repository.tier != "" {
+				r.EnvironmentRegistryURLs[repository.tier] = repository.url(r.config)
+			}
+		}
+	}
 
 	return nil
 }
 
-// grantPipelineIAM grants IAM permissions to the GitHub Actions pipeline
-func (r *GithubGoogleRegistry) grantPipelineIAM(ctx *pulumi.Context, config *Config, registry *artifactregistry.Repository, repoPrincipalID pulumi.StringOutput) ([]*artifactregistry.RepositoryIamMember, []*projects.IAMMember, error) {
-	// Repository-level roles (assigned to the specific repository)
-	repoRoles := []string{
-		"roles/artifactregistry.writer",
+// newCleanupPolicies returns the cleanup policies appropriate for the repository format.
+// With immutable tags, tagged versions are releases and only untagged versions are deleted by age.
+func newCleanupPolicies(format repositoryFormat, keepCount int, olderThan string, immutableTags bool) artifactregistry.RepositoryCleanupPolicyArray {
+	if !format.deleteOldVersions {
+		// Nothing is deleted, so a keep policy would have no effect
+		return artifactregistry.RepositoryCleanupPolicyArray{}
 	}
 
-	// Project-level roles (assigned at the project level)
-	projectRoles := []string{
-		// SBOM generation for container images
-		// See: https://cloud.google.com/artifact-analysis/docs/generate-store-sboms
-		"roles/containeranalysis.notes.editor",
-		"roles/containeranalysis.occurrences.editor",
-		"roles/storage.bucketViewer",
+	deleteTagState := "ANY"
+	if immutableTags {
+		deleteTagState = "UNTAGGED"
 	}
 
-	// Assign repository-level IAM roles
-	repoIAMMembers := make([]*artifactregistry.RepositoryIamMember, 0, len(repoRoles))
+	return artifactregistry.RepositoryCleanupPolicyArray{
+		&artifactregistry.RepositoryCleanupPolicyArgs{
+			Id:     pulumi.String("keep-recent-versions"),
+			Action: pulumi.String("KEEP"),
+			MostRecentVersions: &artifactregistry.RepositoryCleanupPolicyMostRecentVersionsArgs{
+				KeepCount: pulumi.Int(keepCount), // keep the X most recent versions
+			},
+		},
+		&artifactregistry.RepositoryCleanupPolicyArgs{
+			Id:     pulumi.String("delete-old-versions"),
+			Action: pulumi.String("DELETE"),
+			Condition: &artifactregistry.RepositoryCleanupPolicyConditionArgs{
+				OlderThan: pulumi.String(olderThan), // delete versions older than configured days
+				TagState:  pulumi.String(deleteTagState),
+			},
+		},
+	}
+}
 
-	for _, role := range repoRoles {
-		bindingName := fmt.Sprintf("%s-repo-iam-%s", config.ResourcePrefix, role)
+// grantPipelineIAM grants IAM permissions to the GitHub Actions pipeline
+func (r *GithubGoogleRegistry) grantPipelineIAM(ctx *pulumi.Context, config *Config, repositories []*managedRepository, principals []pipelinePrincipal, promotionPrincipalID pulumi.StringOutput) ([]*artifactregistry.RepositoryIamMember, []*projects.IAMMember, error) {
+	// Project-level roles (assigned at the project level) for SBOM generation for container images
+	projectRoles := r.pipelineProjectRoles()
 
-		member, err := artifactregistry.NewRepositoryIamMember(ctx, bindingName, &artifactregistry.RepositoryIamMemberArgs{
-			Repository: registry.Name,
-			Location:   pulumi.String(config.RepositoryLocation),
-			Project:    pulumi.String(config.GCPProject),
-			Role:       pulumi.String(role),
-			Member:     repoPrincipalID,
-		}, pulumi.Parent(r))
+	// Assign repository-level IAM roles
+	repoIAMMembers := make([]*artifactregistry.RepositoryIamMember, 0, len(repositories))
+
+	for _, repository := range repositories {
+		members, err := r.grantRepositoryIAM(ctx, config, repository, principals, promotionPrincipalID)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create repository IAM member: %w", err)
+			return nil, nil, err
 		}
 
-		repoIAMMembers = append(repoIAMMembers, member)
+		repoIAMMembers = append(repoIAMMembers, members...)
 	}
 
 	// Assign project-level IAM roles
-	projectIAMMembers := make([]*projects.IAMMember, 0, len(projectRoles))
+	projectIAMMembers := make([]*projects.IAMMember, 0, len(projectRoles)*len(principals))
+
+	type projectBinding struct {
+		principal pipelinePrincipal
+		roles     []projectRole
+		// Member overrides are not the pipeline, the pipeline conditions don't apply to them
+		override bool
+	}
+
+	extraRoles, err := parseExtraRoles(config.ExtraProjectRoles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pipelineExtraRoles []projectRole
+
+	bindings := make([]projectBinding, 0, len(principals)+len(extraRoles))
+
+	for _, extra := range extraRoles {
+		role := projectRole{key: "extra-" + extra.role, role: pulumi.String(extra.role), project: config.registryProject()}
+		if extra.member == "" {
+			pipelineExtraRoles = append(pipelineExtraRoles, role)
+
+			continue
+		}
+
+		override := pipelinePrincipal{writeID: extra.memberOutput(), key: memberKey(extra.member)}
+		bindings = append(bindings, projectBinding{principal: override, roles: []projectRole{role}, override: true})
+	}
+
+	for _, principal := range principals {
+		if len(principal.profiles) == 0 {
+			bindings = append(bindings, projectBinding{principal: principal, roles: append(append([]projectRole{}, projectRoles...), pipelineExtraRoles...)})
+
+			continue
+		}
+
+		for _, profile := range principal.profiles {
+			bindings = append(bindings, projectBinding{principal: profile, roles: predefinedProjectRoles(profile.profile.ProjectRoles, config.registryProject())})
+		}
+	}
+
+	for _, b := range bindings {
+		for _, role := range b.roles {
+			bindingName := b.principal.bindingName(fmt.Sprintf("%s-project-iam-%s", config.ResourcePrefix, role.key))
+
+			var condition *projects.IAMMemberConditionArgs
+			if !b.override {
+				condition = newProjectIAMCondition(config, role.key)
+			}
+
+			member, err := projects.NewIAMMember(ctx, bindingName, &projects.IAMMemberArgs{
+				Project:   pulumi.String(role.project),
+				Role:      role.role,
+				Member:    b.principal.writeID,
+				Condition: condition,
+			}, pulumi.Parent(r))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create project IAM member: %w", err)
+			}
+
+			projectIAMMembers = append(projectIAMMembers, member)
+		}
+	}
+
+	return repoIAMMembers, projectIAMMembers, nil
+}
+
+// grantRepositoryIAM grants the pipeline and the additional writers and readers access to a repository
+func (r *GithubGoogleRegistry) grantRepositoryIAM(ctx *pulumi.Context, config *Config, repository *managedRepository, principals []pipelinePrincipal, promotionPrincipalID pulumi.StringOutput) ([]*artifactregistry.RepositoryIamMember, error) {
+	type binding struct {
+		role string
+		// suffix for the binding name, empty for the pipeline principal of ALLOWED_REPO_URL
+		key    string
+		member pulumi.StringOutput
+	}
+
+	bindings := make([]binding, 0, 2*len(principals)+1+len(repository.writers)+len(repository.readers))
+
+	for _, principal := range principals {
+		// Each trust profile gets its own roles, the workflows matching none get nothing
+		if len(principal.profiles) > 0 {
+			for _, profile := range principal.profiles {
+				for _, role := range profile.profile.repositoryRoles(repository.pipelineRole) {
+					bindings = append(bindings, binding{role: role, key: profile.key, member: profile.id})
+				}
+			}
+
+			continue
+		}
+
+		switch {
+		case repository.pipelineRole == "roles/artifactregistry.writer" && principal.gated:
+			// Workflows that can't push, like pull requests, can still pull
+			bindings = append(bindings,
+				binding{role: repository.pipelineRole, key: principal.key, member: principal.writeID},
+				binding{role: "roles/artifactregistry.reader", key: principal.key, member: principal.id},
+			)
+		case repository.pipelineRole != "":
+			bindings = append(bindings, binding{role: repository.pipelineRole, key: principal.key, member: principal.id})
+		}
+	}
+
+	if repository.promotionRole != "" {
+		bindings = append(bindings, binding{role: repository.promotionRole, key: "promotion", member: promotionPrincipalID})
+	}
+
+	for _, writer := range repository.writers {
+		bindings = append(bindings, binding{role: "roles/artifactregistry.writer", key: memberKey(writer), member: pulumi.String(writer).ToStringOutput()})
+	}
+
+	for _, reader := range repository.readers {
+		bindings = append(bindings, binding{role: "roles/artifactregistry.reader", key: memberKey(reader), member: pulumi.String(reader).ToStringOutput()})
+	}
+
+	extraRoles, err := parseExtraRoles(config.ExtraRepositoryRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, extra := range extraRoles {
+		if extra.member != "" {
+			bindings = append(bindings, binding{role: extra.role, key: extra.extraBindingKey(pipelinePrincipal{}), member: extra.memberOutput()})
+
+			continue
+		}
+
+		// The pipeline only gets extra roles where it can push, so they never bypass promotion or read-only access
+		if repository.pipelineRole != "roles/artifactregistry.writer" {
+			continue
+		}
+
+		for _, principal := range principals {
+			bindings = append(bindings, binding{role: extra.role, key: extra.extraBindingKey(principal), member: principal.writeID})
+		}
+	}
 
-	for _, role := range projectRoles {
-		bindingName := fmt.Sprintf("%s-project-iam-%s", config.ResourcePrefix, role)
+	repoIAMMembers := make([]*artifactregistry.RepositoryIamMember, 0, len(bindings))
 
-		member, err := projects.NewIAMMember(ctx, bindingName, &projects.IAMMemberArgs{
-			Project: pulumi.String(config.GCPProject),
-			Role:    pulumi.String(role),
-			Member:  repoPrincipalID,
+	for _, b := range bindings {
+		iamMember, err := artifactregistry.NewRepositoryIamMember(ctx, repository.iamBindingName(config.ResourcePrefix, b.role, b.key), &artifactregistry.RepositoryIamMemberArgs{
+			Repository: repository.repository.Name,
+			Location:   pulumi.String(config.RepositoryLocation),
+			Project:    pulumi.String(config.registryProject()),
+			Role:       pulumi.String(b.role),
+			Member:     b.member,
 		}, pulumi.Parent(r))
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to create project IAM member: %w", err)
+			return nil, fmt.Errorf("failed to create repository IAM member: %w", err)
 		}
 
-		projectIAMMembers = append(projectIAMMembers, member)
+		repoIAMMembers = append(repoIAMMembers, iamMember)
 	}
 
-	return repoIAMMembers, projectIAMMembers, nil
+	return repoIAMMembers, nil
 }
 
 // createSBOMsBucket creates a GCS bucket for storing SBOMs with proper IAM permissions
-func (r *GithubGoogleRegistry) createSBOMsBucket(ctx *pulumi.Context, config *Config, repoPrincipalID pulumi.StringOutput) (*storage.Bucket, *storage.BucketIAMMember, error) {
-	// Default bucket name for SBOMs: artifacts-{project-id}-sbom
-	bucketName := fmt.Sprintf("artifacts-%s-sbom", config.GCPProject)
+func (r *GithubGoogleRegistry) createSBOMsBucket(ctx *pulumi.Context, config *Config, principals []pipelinePrincipal, encryption *encryptionKeys) (*storage.Bucket, []*storage.BucketIAMMember, error) {
+	// Default bucket name for SBOMs: artifacts-{bucket project id}-sbom
+	bucketName := sbomBucketName(config)
+
+	var bucketEncryption *storage.BucketEncryptionArgs
+	if encryption.bucket != nil {
+		bucketEncryption = &storage.BucketEncryptionArgs{
+			DefaultKmsKeyName: encryption.bucket,
+		}
+	}
 
 	// Create the bucket with best practices for security and compliance
 	bucket, err := storage.NewBucket(ctx, bucketName, &storage.BucketArgs{
 		Name:         pulumi.String(bucketName),
 		Location:     pulumi.String(config.GCPRegion),
-		Project:      pulumi.String(config.GCPProject),
+		Project:      pulumi.String(config.sbomBucketProject()),
 		ForceDestroy: pulumi.Bool(false), // Prevent accidental deletion
 		Versioning: &storage.BucketVersioningArgs{
 			Enabled: pulumi.Bool(true), // Enable versioning for audit trail
@@ -270,22 +621,78 @@ func (r *GithubGoogleRegistry) createSBOMsBucket(ctx *pulumi.Context, config *Co
 		// Enable Uniform Bucket Level Access (UBLA) for enhanced security
 		// This is required for SBOMs and prevents ACL-based access control
 		UniformBucketLevelAccess: pulumi.Bool(true),
-	}, pulumi.Parent(r))
+		// Encrypt objects with the customer-managed key, if any
+		Encryption: bucketEncryption,
+	},
+		pulumi.Parent(r),
+		pulumi.DependsOn(encryption.dependencies),
+	)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create SBOM bucket: %w", err)
 	}
 
-	// Grant object admin role to the repository principal for SBOM uploads
-	bucketIAMMember, err := storage.NewBucketIAMMember(ctx, fmt.Sprintf("%s-sbom-bucket-iam", config.ResourcePrefix), &storage.BucketIAMMemberArgs{
-		Bucket: bucket.Name,
-		Role:   pulumi.String("roles/storage.objectAdmin"),
-		Member: repoPrincipalID,
-	}, pulumi.Parent(r))
+	// Grant object admin role to the repository principals for SBOM uploads
+	bucketIAMMembers := make([]*storage.BucketIAMMember, 0, len(principals))
+
+	for _, principal := range principals {
+		if len(principal.profiles) > 0 {
+			// Trust profiles only get the bucket roles they list
+			for _, profile := range principal.profiles {
+				for _, role := range profile.profile.BucketRoles {
+					bucketIAMMember, err := storage.NewBucketIAMMember(ctx, profile.bindingName(fmt.Sprintf("%s-sbom-bucket-iam-%s", config.ResourcePrefix, role)), &storage.BucketIAMMemberArgs{
+						Bucket: bucket.Name,
+						Role:   pulumi.String(role),
+						Member: profile.id,
+					}, pulumi.Parent(r))
+					if err != nil {
+						return nil, nil, fmt.Errorf("failed to create SBOM bucket IAM member: %w", err)
+					}
+
+					bucketIAMMembers = append(bucketIAMMembers, bucketIAMMember)
+				}
+			}
+
+			continue
+		}
+
+		bucketIAMMember, err := storage.NewBucketIAMMember(ctx, principal.bindingName(fmt.Sprintf("%s-sbom-bucket-iam", config.ResourcePrefix)), &storage.BucketIAMMemberArgs{
+			Bucket: bucket.Name,
+			Role:   pulumi.String("roles/storage.objectAdmin"),
+			Member: principal.writeID,
+		}, pulumi.Parent(r))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create SBOM bucket IAM member: %w", err)
+		}
+
+		bucketIAMMembers = append(bucketIAMMembers, bucketIAMMember)
+	}
+
+	extraRoles, err := parseExtraRoles(config.ExtraBucketRoles)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create SBOM bucket IAM member: %w", err)
+		return nil, nil, err
 	}
 
-	return bucket, bucketIAMMember, nil
+	for _, extra := range extraRoles {
+		grantees := principals
+		if extra.member != "" {
+			grantees = []pipelinePrincipal{{writeID: extra.memberOutput(), key: memberKey(extra.member)}}
+		}
+
+		for _, principal := range grantees {
+			bucketIAMMember, err := storage.NewBucketIAMMember(ctx, principal.bindingName(fmt.Sprintf("%s-sbom-bucket-iam-extra-%s", config.ResourcePrefix, extra.role)), &storage.BucketIAMMemberArgs{
+				Bucket: bucket.Name,
+				Role:   pulumi.String(extra.role),
+				Member: principal.writeID,
+			}, pulumi.Parent(r))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create SBOM bucket IAM member: %w", err)
+			}
+
+			bucketIAMMembers = append(bucketIAMMembers, bucketIAMMember)
+		}
+	}
+
+	return bucket, bucketIAMMembers, nil
 }
 
 func capToMax(identityProviderName string, maxLen int) string {
@@ -296,69 +703,62 @@ func capToMax(identityProviderName string, maxLen int) string {
 	return identityProviderName
 }
 
-// newGithubActionsOIDCProvider creates a new OIDC provider for GitHub Actions
-func (r *GithubGoogleRegistry) newGithubActionsOIDCProvider(ctx *pulumi.Context, config *Config, repoName string) (*iam.WorkloadIdentityPoolProvider, *iam.WorkloadIdentityPool, error) {
-	// Create OIDC workload identity pool for GitHub Actions
+// newWorkloadIdentityPool creates the workload identity pool shared by the CI providers
+func (r *GithubGoogleRegistry) newWorkloadIdentityPool(ctx *pulumi.Context, config *Config) (*iam.WorkloadIdentityPool, error) {
 	identityPoolName := fmt.Sprintf("%s-github-actions-pool", config.ResourcePrefix)
 	identityPoolName = capToMax(identityPoolName, 32)
 
 	identityPool, err := iam.NewWorkloadIdentityPool(ctx, identityPoolName, &iam.WorkloadIdentityPoolArgs{
 		WorkloadIdentityPoolId: pulumi.String(identityPoolName),
-		Project:                pulumi.String(config.GCPProject),
+		Project:                pulumi.String(config.identityProject()),
 		DisplayName:            pulumi.String("GitHub Actions Workload Pool"),
 		Description:            pulumi.String("Workload identity pool for GitHub Actions"),
 		Disabled:               pulumi.Bool(false),
 	}, pulumi.Parent(r))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create OIDC provider for GitHub Actions: %w", err)
+		return nil, fmt.Errorf("failed to create workload identity pool: %w", err)
 	}
 
-	// Create OIDC provider for GitHub Actions
-	identityProviderName := fmt.Sprintf("%s-%s", config.ResourcePrefix, config.IdentityPoolProviderName)
-	identityProviderName = capToMax(identityProviderName, 32)
+	return identityPool, nil
+}
+
+// newOIDCProvider creates the OIDC provider of a CI system in the workload identity pool
+func (r *GithubGoogleRegistry) newOIDCProvider(ctx *pulumi.Context, config *Config, identityPool *iam.WorkloadIdentityPool, provider identityProvider) (*iam.WorkloadIdentityPoolProvider, error) {
+	identityProviderName := provider.providerID()
+
+	// Display names are limited to 32 characters
+	displayName := fmt.Sprintf("%s OIDC Provider", provider.ciName())
+	if len(displayName) > 32 {
+		displayName = fmt.Sprintf("%s OIDC", provider.ciName())
+	}
 
 	oidcProvider, err := iam.NewWorkloadIdentityPoolProvider(ctx, identityProviderName, &iam.WorkloadIdentityPoolProviderArgs{
 		WorkloadIdentityPoolId:         identityPool.WorkloadIdentityPoolId,
 		WorkloadIdentityPoolProviderId: pulumi.String(identityProviderName),
-		Project:                        pulumi.String(config.GCPProject),
-		DisplayName:                    pulumi.String("GitHub Actions OIDC Provider"),
-		Description:                    pulumi.String("OIDC provider for GitHub Actions"),
+		Project:                        pulumi.String(config.identityProject()),
+		DisplayName:                    pulumi.String(displayName),
+		Description:                    pulumi.Sprintf("OIDC provider for %s", provider.ciName()),
 		Disabled:                       pulumi.Bool(false),
-		AttributeMapping: pulumi.StringMap{
-			"google.subject":                pulumi.String("assertion.sub"),
-			"attribute.repository":          pulumi.String("assertion.repository"),
-			"attribute.repository_owner":    pulumi.String("assertion.repository_owner"),
-			"attribute.repository_owner_id": pulumi.String("assertion.repository_owner_id"),
-			"attribute.repository_id":       pulumi.String("assertion.repository_id"),
-			"attribute.actor":               pulumi.String("assertion.actor"),
-			"attribute.ref":                 pulumi.String("assertion.ref"),
-			"attribute.sha":                 pulumi.String("assertion.sha"),
-			"attribute.workflow":            pulumi.String("assertion.workflow"),
-			"attribute.head_ref":            pulumi.String("assertion.head_ref"),
-			"attribute.base_ref":            pulumi.String("assertion.base_ref"),
-			"attribute.aud":                 pulumi.String("assertion.aud"),
-		},
-		Oidc: &iam.WorkloadIdentityPoolProviderOidcArgs{
-			IssuerUri: pulumi.String("https://token.actions.githubusercontent.com"),
-		},
-		AttributeCondition: pulumi.String(buildAttributeCondition(repoName, config)),
+		AttributeMapping:               provider.attributeMapping(),
+		Oidc:                           provider.oidc(),
+		AttributeCondition:             pulumi.String(provider.attributeCondition().String()),
 	}, pulumi.Parent(r))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create OIDC provider for GitHub Actions: %w", err)
+		return nil, fmt.Errorf("failed to create OIDC provider for %s: %w", provider.ciName(), err)
 	}
 
-	return oidcProvider, identityPool, nil
+	return oidcProvider, nil
 }
 
-// newServiceAccountForDelegation creates a service account and binds it to the workload identity pool
-func (r *GithubGoogleRegistry) newServiceAccountForDelegation(ctx *pulumi.Context, config *Config) (*serviceaccount.Account, error) {
+// newServiceAccountForDelegation creates a service account the pipeline principals can impersonate
+func (r *GithubGoogleRegistry) newServiceAccountForDelegation(ctx *pulumi.Context, config *Config, principals []pipelinePrincipal) (*serviceaccount.Account, error) {
 	// Create a service account for GitHub Actions
 	serviceAccountName := fmt.Sprintf("%s-github-actions-sa", config.ResourcePrefix)
 	serviceAccountName = capToMax(serviceAccountName, 30)
 
 	githubActionsSA, err := serviceaccount.NewAccount(ctx, serviceAccountName, &serviceaccount.AccountArgs{
 		AccountId:   pulumi.String(serviceAccountName),
-		Project:     pulumi.String(config.GCPProject),
+		Project:     pulumi.String(config.registryProject()),
 		DisplayName: pulumi.String("GitHub Actions Service Account"),
 		Description: pulumi.String("Service account for GitHub Actions CI/CD"),
 	}, pulumi.Parent(r))
@@ -366,15 +766,21 @@ func (r *GithubGoogleRegistry) newServiceAccountForDelegation(ctx *pulumi.Contex
 		return nil, fmt.Errorf("failed to create service account for delegation: %w", err)
 	}
 
-	// Bind the service account to the workload identity pool
-	// This allows the service account to be impersonated by the workload identity pool
-	_, err = serviceaccount.NewIAMMember(ctx, fmt.Sprintf("%s-workload-identity-user", config.ResourcePrefix), &serviceaccount.IAMMemberArgs{
-		ServiceAccountId: githubActionsSA.Name,
-		Role:             pulumi.String("roles/iam.workloadIdentityUser"),
-		Member:           pulumi.Sprintf("serviceAccount:%s", githubActionsSA.Email),
-	}, pulumi.Parent(r))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create service account IAM member: %w", err)
+	// Allow the pipelines to impersonate the service account. With push restrictions, only the
+	// workflows allowed to push can, since the service account holds the write roles.
+	r.ServiceAccountIAMMembers = make([]*serviceaccount.IAMMember, 0, len(principals))
+
+	for _, principal := range principals {
+		member, err := serviceaccount.NewIAMMember(ctx, principal.bindingName(fmt.Sprintf("%s-workload-identity-user", config.ResourcePrefix)), &serviceaccount.IAMMemberArgs{
+			ServiceAccountId: githubActionsSA.Name,
+			Role:             pulumi.String("roles/iam.workloadIdentityUser"),
+			Member:           principal.writeID,
+		}, pulumi.Parent(r))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create service account IAM member: %w", err)
+		}
+
+		r.ServiceAccountIAMMembers = append(r.ServiceAccountIAMMembers, member)
 	}
 
 	return githubActionsSA, nil
@@ -382,7 +788,7 @@ func (r *GithubGoogleRegistry) newServiceAccountForDelegation(ctx *pulumi.Contex
 
 func (r *GithubGoogleRegistry) enableRegistryAPI(ctx *pulumi.Context, name, api string) (*projects.Service, error) {
 	service, err := projects.NewService(ctx, r.NewResourceName(name, "api", 63), &projects.ServiceArgs{
-		Project:                  pulumi.String(r.config.GCPProject),
+		Project:                  pulumi.String(r.config.registryProject()),
 		Service:                  pulumi.String(api),
 		DisableOnDestroy:         pulumi.Bool(false),
 		DisableDependentServices: pulumi.Bool(false),
@@ -397,33 +803,91 @@ func (r *GithubGoogleRegistry) enableRegistryAPI(ctx *pulumi.Context, name, api
 	return service, nil
 }
 
-// extractRepoName extracts the repository name from a GitHub URL
-func extractRepoName(repoURL string) string {
-	if len(repoURL) > 19 && repoURL[:19] == "https://github.com/" {
-		return repoURL[19:]
+// extractRepoName parses a GitHub repository reference into owner/repo. It accepts the forms git
+// accepts for a repository on the GitHub server, and a bare owner/repo name:
+//   - https://github.com/my-org/my-repo, with or without a .git suffix or a trailing slash
+//   - git@github.com:my-org/my-repo.git
+//   - ssh://git@github.com/my-org/my-repo.git
+//
+// Schemes and hosts are case-insensitive. The owner and repository keep their case, as in the token claims.
+func extractRepoName(repoURL, serverHost string) (string, error) {
+	reference := strings.TrimSpace(repoURL)
+	if reference == "" {
+		return "", fmt.Errorf("repository URL can't be empty")
 	}
 
-	return repoURL
+	var host, path string
+
+	switch {
+	case strings.Contains(reference, "://"):
+		scheme, rest, _ := strings.Cut(reference, "://")
+		switch strings.ToLower(scheme) {
+		case "https", "http", "ssh":
+		default:
+			return "", fmt.Errorf("repository URL %q must use https or ssh", repoURL)
+		}
+
+		host, path, _ = strings.Cut(rest, "/")
+		// Drop the user of ssh://git@host URLs
+		if _, hostname, found := strings.Cut(host, "@"); found {
+			host = hostname
+		}
+	case strings.Contains(reference, "@") && strings.Contains(reference, ":"):
+		// scp-like syntax, e.g. git@github.com:my-org/my-repo.git
+		_, rest, _ := strings.Cut(reference, "@")
+		host, path, _ = strings.Cut(rest, ":")
+	default:
+		path = reference
+	}
+
+	if host != "" && !strings.EqualFold(host, serverHost) {
+		return "", fmt.Errorf("repository URL %q is not on the GitHub server %s, set GITHUB_SERVER_URL", repoURL, serverHost)
+	}
+
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "/"), ".git")
+
+	owner, repo, found := strings.Cut(path, "/")
+	if !found || strings.Contains(repo, "/") {
+		return "", fmt.Errorf("repository URL %q must point to a repository (e.g. https://%s/my-org/my-repo)", repoURL, serverHost)
+	}
+
+	if len(owner) > maxGitHubOwnerLength || !githubOwnerPattern.MatchString(owner) {
+		return "", fmt.Errorf("repository owner %q in %q must be letters, digits and single hyphens, at most %d characters", owner, repoURL, maxGitHubOwnerLength)
+	}
+
+	if len(repo) > maxGitHubRepositoryLength || !githubRepositoryPattern.MatchString(repo) || repo == "." || repo == ".." {
+		return "", fmt.Errorf("repository name %q in %q must be letters, digits, '.', '_' and '-', at most %d characters", repo, repoURL, maxGitHubRepositoryLength)
+	}
+
+	return fmt.Sprintf("%s/%s", owner, repo), nil
 }
 
 // buildAttributeCondition creates a secure attribute condition for the OIDC provider
-func buildAttributeCondition(repoName string, config *Config) string {
-	// Start with repository constraint
-	condition := fmt.Sprintf(`attribute.repository == "%s"`, repoName)
+func buildAttributeCondition(repoNames []string, config *Config) celExpr {
+	var condition celExpr
+
+	switch {
+	case config.TrustOwnerRepositories:
+		// Every repository of the owner, filtered by name patterns
+		condition = ownerRepositoriesCondition(config)
+	default:
+		// Trusting several repositories is a membership test rather than a list of alternatives
+		condition = celAnyOf("attribute.repository", repoNames)
+	}
 
 	// Add repository owner constraint if provided
 	if config.RepositoryOwner != "" {
-		condition += fmt.Sprintf(` && attribute.repository_owner == "%s"`, config.RepositoryOwner)
+		condition = celAnd(condition, celEquals("attribute.repository_owner", config.RepositoryOwner))
 	}
 
-	// Add repository owner ID constraint if provided (recommended for security)
-	if config.RepositoryOwnerID != "" {
-		condition += fmt.Sprintf(` && attribute.repository_owner_id == "%s"`, config.RepositoryOwnerID)
+	// Add repository owner ID constraint if provided (recommended for security), owner-wide trust starts with it
+	if config.RepositoryOwnerID != "" && !config.TrustOwnerRepositories {
+		condition = celAnd(condition, celEquals("attribute.repository_owner_id", config.RepositoryOwnerID))
 	}
 
 	// Add repository ID constraint if provided (recommended for security)
 	if config.RepositoryID != "" {
-		condition += fmt.Sprintf(` && attribute.repository_id == "%s"`, config.RepositoryID)
+		condition = celAnd(condition, celEquals("attribute.repository_id", config.RepositoryID))
 	}
 
 	return condition
@@ -1,9 +1,15 @@
 package ci_test
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/davidmontoyago/pulumi-gcp-github-registry/deploy/ci"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/serviceaccount"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/storage"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/stretchr/testify/assert"
@@ -75,6 +81,10 @@ func (m *infraMocks) NewResource(args pulumi.MockResourceArgs) (string, resource
 	//   - bucket: string (bucket name reference)
 	//   - role: string (IAM role, e.g., "roles/storage.objectAdmin")
 	//   - member: string (principal to bind, e.g., "principalSet://...")
+	//
+	// gcp:secretmanager/secretVersion:SecretVersion
+	//   - name: string (full secret version resource name, computed)
+	//   - secret: string (secret ID reference)
 	outputs := map[string]interface{}{}
 	for k, v := range args.Inputs {
 		outputs[string(k)] = v
@@ -106,19 +116,123 @@ func (m *infraMocks) NewResource(args pulumi.MockResourceArgs) (string, resource
 		// Expected outputs: name, location, project, versioning, lifecycleRules, labels, uniformBucketLevelAccess
 	case "gcp:storage/bucketIAMMember:BucketIAMMember":
 		// Expected outputs: bucket, role, member
+	case "gcp:secretmanager/secretVersion:SecretVersion":
+		outputs["name"] = "projects/test-project/secrets/" + args.Name + "/versions/1"
+		// Expected outputs: name, secret, secretData
+	case "gcp:projects/iAMCustomRole:IAMCustomRole":
+		outputs["name"] = "projects/test-project/roles/" + args.Inputs["roleId"].StringValue()
+		// Expected outputs: name, roleId, project, title, permissions
+	case "gcp:projects/serviceIdentity:ServiceIdentity":
+		agent := strings.TrimSuffix(args.Inputs["service"].StringValue(), ".googleapis.com")
+		outputs["email"] = "service-123456789012@gcp-sa-" + agent + ".iam.gserviceaccount.com"
+		outputs["member"] = "serviceAccount:" + outputs["email"].(string)
+		// Expected outputs: project, service, email, member
 	case "gcp:organizations/project:Project":
 		outputs["name"] = args.Name
 		outputs["number"] = "123456789012" // Numeric project ID - used in workload identity provider ID
+		if args.ID == "security-project" {
+			outputs["number"] = "210987654321"
+		}
 		// Expected outputs: name, projectId, number, autoCreateNetwork
 	}
 
 	return args.Name + "_id", resource.NewPropertyMapFromMap(outputs), nil
 }
 
-func (m *infraMocks) Call(_ pulumi.MockCallArgs) (resource.PropertyMap, error) {
+func (m *infraMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	switch args.Token {
+	case "gcp:storage/getProjectServiceAccount:getProjectServiceAccount":
+		email := "service-123456789012@gs-project-accounts.iam.gserviceaccount.com"
+
+		return resource.NewPropertyMapFromMap(map[string]interface{}{
+			"emailAddress": email,
+			"member":       "serviceAccount:" + email,
+		}), nil
+	}
+
 	return resource.PropertyMap{}, nil
 }
 
+// iamGrant is the role and member of an IAM member resource
+type iamGrant struct {
+	role   string
+	member string
+}
+
+// awaitGrants resolves the role and member of each IAM member resource, in order
+func awaitGrants[T any](resources []T, roleAndMember func(T) (pulumi.StringOutput, pulumi.StringOutput)) []iamGrant {
+	grants := make([]iamGrant, 0, len(resources))
+	grantCh := make(chan iamGrant, 1)
+
+	for _, res := range resources {
+		role, member := roleAndMember(res)
+
+		pulumi.All(role, member).ApplyT(func(args []interface{}) iamGrant {
+			g := iamGrant{role: args[0].(string), member: args[1].(string)}
+			grantCh <- g
+
+			return g
+		})
+
+		grants = append(grants, <-grantCh)
+	}
+
+	return grants
+}
+
+func repositoryGrants(members []*artifactregistry.RepositoryIamMember) []iamGrant {
+	return awaitGrants(members, func(m *artifactregistry.RepositoryIamMember) (pulumi.StringOutput, pulumi.StringOutput) {
+		return m.Role, m.Member
+	})
+}
+
+func projectGrants(members []*projects.IAMMember) []iamGrant {
+	return awaitGrants(members, func(m *projects.IAMMember) (pulumi.StringOutput, pulumi.StringOutput) {
+		return m.Role, m.Member
+	})
+}
+
+func serviceAccountGrants(members []*serviceaccount.IAMMember) []iamGrant {
+	return awaitGrants(members, func(m *serviceaccount.IAMMember) (pulumi.StringOutput, pulumi.StringOutput) {
+		return m.Role, m.Member
+	})
+}
+
+func bucketGrants(members []*storage.BucketIAMMember) []iamGrant {
+	return awaitGrants(members, func(m *storage.BucketIAMMember) (pulumi.StringOutput, pulumi.StringOutput) {
+		return m.Role, m.Member
+	})
+}
+
+// membersWithRole returns the members granted a role, in order
+func membersWithRole(grants []iamGrant, role string) []string {
+	var members []string
+
+	for _, g := range grants {
+		if g.role == role {
+			members = append(members, g.member)
+		}
+	}
+
+	return members
+}
+
+// allMembers returns every member granted a role
+func allMembers(grants []iamGrant) []string {
+	members := make([]string, 0, len(grants))
+	for _, g := range grants {
+		members = append(members, g.member)
+	}
+
+	return members
+}
+
+// Principals of the test/repo repository in the test pool
+const (
+	testPool          = "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool"
+	testRepoPrincipal = testPool + "/attribute.repository/test/repo"
+)
+
 func TestNewGithubGoogleRegistry(t *testing.T) {
 	t.Parallel()
 
@@ -233,7 +347,7 @@ func TestNewGithubGoogleRegistry(t *testing.T) {
 		})
 
 		principal := <-principalCh
-		assert.Equal(t, principal, "principalSet://iam.googleapis.com/ci-with-a-long-prefix-github-act/attribute.repository/test/repo")
+		assert.Equal(t, principal, "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-with-a-long-prefix-github-act/attribute.repository/test/repo")
 
 		// ------- Repository-level IAM -------
 
@@ -246,7 +360,7 @@ func TestNewGithubGoogleRegistry(t *testing.T) {
 		})
 
 		firstMember := <-memberCh
-		assert.Equal(t, firstMember, "principalSet://iam.googleapis.com/ci-with-a-long-prefix-github-act/attribute.repository/test/repo")
+		assert.Equal(t, firstMember, "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-with-a-long-prefix-github-act/attribute.repository/test/repo")
 
 		roleCh := make(chan string, 1)
 
@@ -319,7 +433,7 @@ func TestNewGithubGoogleRegistry(t *testing.T) {
 		})
 
 		bucketMember := <-bucketMemberCh
-		assert.Equal(t, "principalSet://iam.googleapis.com/ci-with-a-long-prefix-github-act/attribute.repository/test/repo", bucketMember)
+		assert.Equal(t, "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-with-a-long-prefix-github-act/attribute.repository/test/repo", bucketMember)
 
 		// Uniform Bucket Level Access is required for SBOMs
 		ublaCh := make(chan bool, 1)
@@ -359,3 +473,2390 @@ func TestNewGithubGoogleRegistry(t *testing.T) {
 		t.Fatalf("Pulumi WithMocks failed: %v", err)
 	}
 }
+
+func TestNewGithubGoogleRegistryPackageFormat(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us-central1",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "packages",
+			RepositoryFormat:          "npm",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		formatCh := make(chan string, 1)
+
+		infra.RegistryFormat.ApplyT(func(format string) string {
+			formatCh <- format
+
+			return format
+		})
+
+		assert.Equal(t, "NPM", <-formatCh)
+
+		regURLCh := make(chan string, 1)
+
+		infra.RegistryURL.ApplyT(func(url string) string {
+			regURLCh <- url
+
+			return url
+		})
+
+		assert.Equal(t, "https://us-central1-npm.pkg.dev/test-project/ci-packages/", <-regURLCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryUnsupportedFormat(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:         "test-project",
+			GCPRegion:          "us-central1",
+			RepositoryLocation: "us-central1",
+			ResourcePrefix:     "ci",
+			RepositoryName:     "registry",
+			RepositoryFormat:   "rubygems",
+			AllowedRepoURL:     "https://github.com/test/repo",
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		assert.ErrorContains(t, err, "unsupported repository format \"rubygems\"")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryRemoteCaches(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			RemoteCaches:             []string{"docker-hub", "ghcr", "internal=https://registry.example.com"},
+			RemoteCacheUsernames:     map[string]string{"docker-hub": "test-user"},
+			RemoteCachePasswords:     map[string]string{"docker-hub": "test-token"},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		require.Len(t, infra.RemoteCacheRepositories, 3)
+		require.Len(t, infra.RemoteCacheIAMMembers, 3)
+
+		urlsCh := make(chan map[string]string, 1)
+
+		infra.RemoteCacheURLs.ToStringMapOutput().ApplyT(func(urls map[string]string) map[string]string {
+			urlsCh <- urls
+
+			return urls
+		})
+
+		urls := <-urlsCh
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-docker-hub-cache", urls["docker-hub"])
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-ghcr-cache", urls["ghcr"])
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-internal-cache", urls["internal"])
+
+		// The pipeline can pull through every cache
+		roleCh := make(chan string, 1)
+
+		infra.RemoteCacheIAMMembers[0].Role.ApplyT(func(role string) string {
+			roleCh <- role
+
+			return role
+		})
+
+		assert.Equal(t, "roles/artifactregistry.reader", <-roleCh)
+
+		memberCh := make(chan string, 1)
+
+		infra.RemoteCacheIAMMembers[0].Member.ApplyT(func(member string) string {
+			memberCh <- member
+
+			return member
+		})
+
+		assert.Equal(t, "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/repo", <-memberCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryRemoteCacheCredentialsRequirePassword(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:           "test-project",
+			GCPRegion:            "us-central1",
+			RepositoryLocation:   "us",
+			ResourcePrefix:       "ci",
+			RepositoryName:       "registry",
+			AllowedRepoURL:       "https://github.com/test/repo",
+			RemoteCaches:         []string{"docker-hub"},
+			RemoteCacheUsernames: map[string]string{"docker-hub": "test-user"},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		assert.ErrorContains(t, err, "remote cache \"docker-hub\" requires both a username and a password")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryVirtualRepository(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                  "test-project",
+			GCPRegion:                   "us-central1",
+			RepositoryLocation:          "us",
+			ResourcePrefix:              "ci",
+			RepositoryName:              "registry",
+			AllowedRepoURL:              "https://github.com/test/repo",
+			IdentityPoolProviderName:    "github-actions-provider",
+			RemoteCaches:                []string{"docker-hub", "ghcr"},
+			VirtualRepository:           true,
+			VirtualRepositoryPriorities: map[string]int{"ghcr": 50},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		require.NotNil(t, infra.VirtualRepository)
+
+		urlCh := make(chan string, 1)
+
+		infra.VirtualRegistryURL.ApplyT(func(url string) string {
+			urlCh <- url
+
+			return url
+		})
+
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-registry-virtual", <-urlCh)
+
+		policiesCh := make(chan []artifactregistry.RepositoryVirtualRepositoryConfigUpstreamPolicy, 1)
+
+		infra.VirtualRepository.VirtualRepositoryConfig.UpstreamPolicies().ApplyT(func(policies []artifactregistry.RepositoryVirtualRepositoryConfigUpstreamPolicy) []artifactregistry.RepositoryVirtualRepositoryConfigUpstreamPolicy {
+			policiesCh <- policies
+
+			return policies
+		})
+
+		priorities := map[string]int{}
+		for _, policy := range <-policiesCh {
+			priorities[*policy.Id] = *policy.Priority
+		}
+
+		// Configured priority wins over declaration order, and the registry is always first
+		assert.Equal(t, 50, priorities["ghcr"])
+		assert.Equal(t, 20, priorities["docker-hub"])
+		assert.Equal(t, 60, priorities["registry"])
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryMultipleRepositories(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			Repositories: ci.RepositorySpecs{
+				{Name: "services"},
+				{
+					Name:           "base-images",
+					PipelineAccess: ci.PipelineAccessReader,
+					Writers:        []string{"serviceAccount:image-builder@test-project.iam.gserviceaccount.com"},
+				},
+				{Name: "tooling", Format: "npm", Labels: map[string]string{"team": "platform"}},
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		require.Len(t, infra.Repositories, 3)
+
+		urlsCh := make(chan map[string]string, 1)
+
+		infra.RegistryURLs.ToStringMapOutput().ApplyT(func(urls map[string]string) map[string]string {
+			urlsCh <- urls
+
+			return urls
+		})
+
+		urls := <-urlsCh
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-services", urls["services"])
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-base-images", urls["base-images"])
+		assert.Equal(t, "https://us-npm.pkg.dev/test-project/ci-tooling/", urls["tooling"])
+
+		// The first repository is the primary one
+		regURLCh := make(chan string, 1)
+
+		infra.RegistryURL.ApplyT(func(url string) string {
+			regURLCh <- url
+
+			return url
+		})
+
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-services", <-regURLCh)
+
+		labelsCh := make(chan map[string]string, 1)
+
+		infra.Repositories["tooling"].Labels.ApplyT(func(labels map[string]string) map[string]string {
+			labelsCh <- labels
+
+			return labels
+		})
+
+		labels := <-labelsCh
+		assert.Equal(t, "platform", labels["team"])
+		assert.Equal(t, "npm-packages", labels["purpose"])
+		assert.Equal(t, "pulumi", labels["managed-by"])
+
+		// services: pipeline writer, base-images: pipeline reader + builder writer, tooling: pipeline writer
+		require.Len(t, infra.RepositoryIAMMembers, 4)
+
+		roles := make([]string, 0, len(infra.RepositoryIAMMembers))
+		roleCh := make(chan string, 1)
+
+		for _, member := range infra.RepositoryIAMMembers {
+			member.Role.ApplyT(func(role string) string {
+				roleCh <- role
+
+				return role
+			})
+
+			roles = append(roles, <-roleCh)
+		}
+
+		assert.Equal(t, []string{
+			"roles/artifactregistry.writer",
+			"roles/artifactregistry.reader",
+			"roles/artifactregistry.writer",
+			"roles/artifactregistry.writer",
+		}, roles)
+
+		memberCh := make(chan string, 1)
+
+		infra.RepositoryIAMMembers[2].Member.ApplyT(func(member string) string {
+			memberCh <- member
+
+			return member
+		})
+
+		assert.Equal(t, "serviceAccount:image-builder@test-project.iam.gserviceaccount.com", <-memberCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryEnvironmentTiers(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			EnvironmentTiers:         []string{"dev", "staging", "prod"},
+			PromotionWorkflow:        ".github/workflows/promote.yml",
+			PromotionRef:             "refs/heads/main",
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		urlsCh := make(chan map[string]string, 1)
+
+		infra.EnvironmentRegistryURLs.ToStringMapOutput().ApplyT(func(urls map[string]string) map[string]string {
+			urlsCh <- urls
+
+			return urls
+		})
+
+		urls := <-urlsCh
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-registry-dev", urls["dev"])
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-registry-staging", urls["staging"])
+		assert.Equal(t, "us-docker.pkg.dev/test-project/ci-registry-prod", urls["prod"])
+
+		principalCh := make(chan string, 1)
+
+		infra.PromotionPrincipalID.ApplyT(func(principal string) string {
+			principalCh <- principal
+
+			return principal
+		})
+
+		promotionPrincipal := <-principalCh
+		assert.Equal(t, "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.workflow_ref/test/repo/.github/workflows/promote.yml@refs/heads/main", promotionPrincipal)
+
+		repoGrants := repositoryGrants(infra.RepositoryIAMMembers)
+
+		// The tiers replace the registry repository: dev, then staging and prod
+		assert.NotContains(t, infra.Repositories, "registry")
+		assert.Equal(t, []iamGrant{
+			{role: "roles/artifactregistry.writer", member: testRepoPrincipal},
+			{role: "roles/artifactregistry.reader", member: promotionPrincipal},
+			{role: "roles/artifactregistry.writer", member: promotionPrincipal},
+			{role: "roles/artifactregistry.writer", member: promotionPrincipal},
+		}, repoGrants)
+
+		// Only the promotion workflow can push past the lowest tier
+		assert.Equal(t, []string{testRepoPrincipal, promotionPrincipal, promotionPrincipal}, membersWithRole(repoGrants, "roles/artifactregistry.writer"))
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryEnvironmentTiersWithServiceAccountAuthMode(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			EnvironmentTiers:         []string{"dev", "prod"},
+			PromotionWorkflow:        ".github/workflows/promote.yml",
+			PromotionRef:             "refs/heads/main",
+			AuthMode:                 ci.AuthModeServiceAccount,
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ENVIRONMENT_TIERS require the direct or both auth mode")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryImmutableTags(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			ImmutableTags:             true,
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		registry := infra.Repositories["registry"]
+
+		immutableCh := make(chan *bool, 1)
+
+		registry.DockerConfig.ImmutableTags().ApplyT(func(immutable *bool) *bool {
+			immutableCh <- immutable
+
+			return immutable
+		})
+
+		immutable := <-immutableCh
+		require.NotNil(t, immutable)
+		assert.True(t, *immutable)
+
+		// Tagged releases are never garbage collected
+		policiesCh := make(chan []artifactregistry.RepositoryCleanupPolicy, 1)
+
+		registry.CleanupPolicies.ApplyT(func(policies []artifactregistry.RepositoryCleanupPolicy) []artifactregistry.RepositoryCleanupPolicy {
+			policiesCh <- policies
+
+			return policies
+		})
+
+		policies := <-policiesCh
+		require.Len(t, policies, 2)
+		assert.Equal(t, "delete-old-versions", policies[1].Id)
+		assert.Equal(t, "UNTAGGED", *policies[1].Condition.TagState)
+
+		outputCh := make(chan map[string]bool, 1)
+
+		infra.ImmutableTags.ToBoolMapOutput().ApplyT(func(tags map[string]bool) map[string]bool {
+			outputCh <- tags
+
+			return tags
+		})
+
+		assert.Equal(t, map[string]bool{"registry": true}, <-outputCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCreatedKMSKeys(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			CreateKMSKey:              true,
+			KMSKeyRotationPeriod:      "7776000s",
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		// The multi-region repository and the regional bucket each get a key in their location
+		require.Len(t, infra.KMSCryptoKeys, 2)
+		require.Len(t, infra.KMSKeyIAMMembers, 2)
+
+		repoKeyCh := make(chan *string, 1)
+
+		infra.Repositories["registry"].KmsKeyName.ApplyT(func(key *string) *string {
+			repoKeyCh <- key
+
+			return key
+		})
+
+		repoKey := <-repoKeyCh
+		require.NotNil(t, repoKey)
+		assert.Equal(t, "ci-us-artifacts-key_id", *repoKey)
+
+		bucketKeyCh := make(chan *string, 1)
+
+		infra.SBOMBucket.Encryption.DefaultKmsKeyName().ApplyT(func(key *string) *string {
+			bucketKeyCh <- key
+
+			return key
+		})
+
+		bucketKey := <-bucketKeyCh
+		require.NotNil(t, bucketKey)
+		assert.Equal(t, "ci-us-central1-artifacts-key_id", *bucketKey)
+
+		rotationCh := make(chan *string, 1)
+
+		infra.KMSCryptoKeys[0].RotationPeriod.ApplyT(func(period *string) *string {
+			rotationCh <- period
+
+			return period
+		})
+
+		rotation := <-rotationCh
+		require.NotNil(t, rotation)
+		assert.Equal(t, "7776000s", *rotation)
+
+		// The Artifact Registry and Cloud Storage service agents can use their keys
+		membersCh := make(chan []string, 1)
+
+		pulumi.All(infra.KMSKeyIAMMembers[0].Member, infra.KMSKeyIAMMembers[1].Member).ApplyT(func(args []interface{}) []string {
+			members := []string{args[0].(string), args[1].(string)}
+			membersCh <- members
+
+			return members
+		})
+
+		assert.Equal(t, []string{
+			"serviceAccount:service-123456789012@gcp-sa-artifactregistry.iam.gserviceaccount.com",
+			"serviceAccount:service-123456789012@gs-project-accounts.iam.gserviceaccount.com",
+		}, <-membersCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryKMSKeyLocationMismatch(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			KMSKeyName:               "projects/kms-project/locations/us/keyRings/artifacts/cryptoKeys/registry",
+		}
+
+		// The bucket is regional and can't default to the multi-region repository key
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "SBOM_BUCKET_KMS_KEY_NAME is in location us but must be in us-central1")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCustomCleanupPolicies(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			CleanupPolicyDryRun:       true,
+			CleanupPolicies: ci.CleanupPolicySpecs{
+				{ID: "keep-releases", Action: "keep", TagPrefixes: []string{"v"}},
+				{ID: "keep-recent-app", Action: "KEEP", PackageNamePrefixes: []string{"app"}, KeepCount: 20},
+				{ID: "delete-untagged", Action: "DELETE", TagState: "untagged", OlderThan: "7d"},
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		registry := infra.Repositories["registry"]
+
+		policiesCh := make(chan []artifactregistry.RepositoryCleanupPolicy, 1)
+
+		registry.CleanupPolicies.ApplyT(func(policies []artifactregistry.RepositoryCleanupPolicy) []artifactregistry.RepositoryCleanupPolicy {
+			policiesCh <- policies
+
+			return policies
+		})
+
+		policies := <-policiesCh
+		require.Len(t, policies, 3)
+
+		// Tag prefixes imply the tagged state
+		assert.Equal(t, "keep-releases", policies[0].Id)
+		assert.Equal(t, "KEEP", *policies[0].Action)
+		assert.Equal(t, "TAGGED", *policies[0].Condition.TagState)
+		assert.Equal(t, []string{"v"}, policies[0].Condition.TagPrefixes)
+
+		// Per-package keep counts have no condition
+		assert.Nil(t, policies[1].Condition)
+		require.NotNil(t, policies[1].MostRecentVersions)
+		assert.Equal(t, 20, *policies[1].MostRecentVersions.KeepCount)
+		assert.Equal(t, []string{"app"}, policies[1].MostRecentVersions.PackageNamePrefixes)
+
+		assert.Equal(t, "DELETE", *policies[2].Action)
+		assert.Equal(t, "UNTAGGED", *policies[2].Condition.TagState)
+		assert.Equal(t, "7d", *policies[2].Condition.OlderThan)
+
+		dryRunCh := make(chan *bool, 1)
+
+		registry.CleanupPolicyDryRun.ApplyT(func(dryRun *bool) *bool {
+			dryRunCh <- dryRun
+
+			return dryRun
+		})
+
+		dryRun := <-dryRunCh
+		require.NotNil(t, dryRun)
+		assert.True(t, *dryRun)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCleanupPolicyWithoutCondition(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			CleanupPolicies: ci.CleanupPolicySpecs{
+				{ID: "delete-everything", Action: "DELETE"},
+			},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `cleanup policy "delete-everything": DELETE policies must match on a tag state, a prefix or an age`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCleanupPolicyDeletingImmutableTags(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			ImmutableTags:            true,
+			CleanupPolicies: ci.CleanupPolicySpecs{
+				{ID: "delete-untagged", Action: "DELETE", TagState: "UNTAGGED", OlderThan: "7d"},
+				{ID: "delete-old", Action: "DELETE", OlderThan: "30d"},
+			},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `repository "registry": cleanup policy "delete-old": DELETE policies must match UNTAGGED versions with immutable tags, got ANY`)
+
+		// Tagged versions are releases too, even when matched by prefix
+		config.CleanupPolicies = ci.CleanupPolicySpecs{
+			{ID: "delete-old-branches", Action: "DELETE", TagPrefixes: []string{"pr-"}, OlderThan: "30d"},
+		}
+
+		_, err = ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `cleanup policy "delete-old-branches": DELETE policies must match UNTAGGED versions with immutable tags, got TAGGED`)
+
+		// Keep policies and untagged deletes are allowed
+		config.CleanupPolicies = ci.CleanupPolicySpecs{
+			{ID: "keep-releases", Action: "KEEP", TagPrefixes: []string{"v"}},
+			{ID: "delete-untagged", Action: "DELETE", TagState: "UNTAGGED", OlderThan: "7d"},
+		}
+
+		_, err = ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryVulnerabilityScanning(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			VulnerabilityScanning:     "Enabled",
+			Repositories: ci.RepositorySpecs{
+				{Name: "registry"},
+				{Name: "scratch", VulnerabilityScanning: "disabled"},
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		enablementCh := make(chan []string, 1)
+
+		pulumi.All(
+			infra.Repositories["registry"].VulnerabilityScanningConfig.EnablementConfig(),
+			infra.Repositories["scratch"].VulnerabilityScanningConfig.EnablementConfig(),
+		).ApplyT(func(args []interface{}) []string {
+			enablement := []string{*args[0].(*string), *args[1].(*string)}
+			enablementCh <- enablement
+
+			return enablement
+		})
+
+		// Enabled repositories rely on the project level API, disabled ones opt out
+		assert.Equal(t, []string{"INHERITED", "DISABLED"}, <-enablementCh)
+		assert.Len(t, infra.VulnerabilityScanningStates, 2)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryMultipleAllowedRepositories(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			RepositoryOwner:           "test",
+			AllowedRepoURLs: []string{
+				"https://github.com/test/repo",
+				"https://github.com/test/service-a",
+				"https://github.com/test/service-b",
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		conditionCh := make(chan *string, 1)
+
+		infra.OidcProvider.AttributeCondition.ApplyT(func(condition *string) *string {
+			conditionCh <- condition
+
+			return condition
+		})
+
+		condition := <-conditionCh
+		require.NotNil(t, condition)
+		assert.Equal(t, `attribute.repository in ["test/repo", "test/service-a", "test/service-b"] && attribute.repository_owner == "test"`, *condition)
+
+		principalsCh := make(chan map[string]string, 1)
+
+		infra.RepositoryPrincipalIDs.ToStringMapOutput().ApplyT(func(principals map[string]string) map[string]string {
+			principalsCh <- principals
+
+			return principals
+		})
+
+		assert.Equal(t, map[string]string{
+			"test/repo":      "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/repo",
+			"test/service-a": "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/service-a",
+			"test/service-b": "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/service-b",
+		}, <-principalsCh)
+
+		// Every repository can push to the registry, upload SBOMs and write analysis notes
+		assert.Len(t, infra.RepositoryIAMMembers, 3)
+		assert.Len(t, infra.SBOMBucketIAMMembers, 3)
+		assert.Len(t, infra.ProjectIAMMembers, 9)
+
+		membersCh := make(chan []string, 1)
+
+		pulumi.All(
+			infra.RepositoryIAMMembers[0].Member,
+			infra.RepositoryIAMMembers[2].Member,
+		).ApplyT(func(args []interface{}) []string {
+			members := []string{args[0].(string), args[1].(string)}
+			membersCh <- members
+
+			return members
+		})
+
+		assert.Equal(t, []string{
+			"principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/repo",
+			"principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/service-b",
+		}, <-membersCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCollidingAllowedRepositories(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			IdentityPoolProviderName: "github-actions-provider",
+			AllowedRepoURLs: []string{
+				"https://github.com/org/my-repo",
+				"https://github.com/org-my/repo",
+			},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `repositories "org/my-repo" and "org-my/repo" can't both be allowed, their IAM binding names would collide`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryOwnerRepositories(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			RepositoryOwnerID:         "123456",
+			TrustOwnerRepositories:    true,
+			RepositoryIncludePatterns: []string{"service-*", "lib.?"},
+			RepositoryExcludePatterns: []string{"*-sandbox"},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		conditionCh := make(chan *string, 1)
+
+		infra.OidcProvider.AttributeCondition.ApplyT(func(condition *string) *string {
+			conditionCh <- condition
+
+			return condition
+		})
+
+		condition := <-conditionCh
+		require.NotNil(t, condition)
+		assert.Equal(t,
+			`attribute.repository_owner_id == "123456" && `+
+				`(attribute.repository.matches("^[^/]+/service-[^/]*$") || attribute.repository.matches("^[^/]+/lib\\.[^/]$")) && `+
+				`!attribute.repository.matches("^[^/]+/[^/]*-sandbox$")`,
+			*condition)
+
+		principalCh := make(chan string, 1)
+
+		infra.RepositoryPrincipalID.ApplyT(func(principal string) string {
+			principalCh <- principal
+
+			return principal
+		})
+
+		assert.Equal(t, "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository_owner_id/123456", <-principalCh)
+		assert.Len(t, infra.RepositoryIAMMembers, 1)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryOwnerRepositoriesRequireOwnerID(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			RepositoryOwner:          "test",
+			TrustOwnerRepositories:   true,
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "TRUST_OWNER_REPOSITORIES requires REPOSITORY_OWNER_ID")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryPushRestrictions(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			AllowedRefs:               []string{"refs/heads/main", "refs/tags/v*"},
+			AllowedEnvironments:       []string{"production"},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		mappingCh := make(chan map[string]string, 1)
+
+		infra.OidcProvider.AttributeMapping.ApplyT(func(mapping map[string]string) map[string]string {
+			mappingCh <- mapping
+
+			return mapping
+		})
+
+		mapping := <-mappingCh
+		assert.Equal(t,
+			`assertion.repository + ":" + (!assertion.event_name.startsWith("pull_request") && `+
+				`(assertion.ref == "refs/heads/main" || assertion.ref.matches("^refs/tags/v.*$")) && `+
+				`(has(assertion.environment) && assertion.environment in ["production"]) ? "write" : "read")`,
+			mapping["attribute.repository_access"])
+
+		// Pushing requires the write principal, every other workflow can pull
+		repoGrants := repositoryGrants(infra.RepositoryIAMMembers)
+		writePrincipal := testPool + "/attribute.repository_access/test/repo:write"
+
+		assert.Equal(t, []iamGrant{
+			{role: "roles/artifactregistry.writer", member: writePrincipal},
+			{role: "roles/artifactregistry.reader", member: testRepoPrincipal},
+		}, repoGrants)
+		assert.NotContains(t, membersWithRole(repoGrants, "roles/artifactregistry.writer"), testRepoPrincipal)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryAllowedReusableWorkflows(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			AllowedReusableWorkflows: []string{
+				"test/workflows/.github/workflows/build.yml@refs/tags/v2",
+				"test/workflows/.github/workflows/release.yml@refs/tags/v3.*",
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		mappingCh := make(chan map[string]string, 1)
+
+		infra.OidcProvider.AttributeMapping.ApplyT(func(mapping map[string]string) map[string]string {
+			mappingCh <- mapping
+
+			return mapping
+		})
+
+		mapping := <-mappingCh
+		assert.Equal(t, "assertion.job_workflow_ref", mapping["attribute.job_workflow_ref"])
+		assert.Equal(t, "assertion.job_workflow_sha", mapping["attribute.job_workflow_sha"])
+		assert.Equal(t,
+			`assertion.repository + ":" + (!assertion.event_name.startsWith("pull_request") && `+
+				`(assertion.job_workflow_ref == "test/workflows/.github/workflows/build.yml@refs/tags/v2" || `+
+				`assertion.job_workflow_ref.matches("^test/workflows/\\.github/workflows/release\\.yml@refs/tags/v3\\..*$")) ? "write" : "read")`,
+			mapping["attribute.repository_access"])
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryEnterpriseIssuer(t *testing.T) {
+	t.Parallel()
+
+	jwks := `{"keys":[{"kty":"RSA","alg":"RS256","kid":"test","use":"sig","e":"AQAB","n":"test"}]}`
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			GitHubServerURL:           "https://my-enterprise.ghe.com",
+			AllowedRepoURL:            "https://my-enterprise.ghe.com/test/repo",
+			OIDCJwksJSON:              jwks,
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		oidcCh := make(chan []string, 1)
+
+		pulumi.All(
+			infra.OidcProvider.Oidc.IssuerUri().Elem(),
+			infra.OidcProvider.Oidc.JwksJson().Elem(),
+			infra.OidcProvider.AttributeCondition.Elem(),
+		).ApplyT(func(args []interface{}) []string {
+			values := []string{args[0].(string), args[1].(string), args[2].(string)}
+			oidcCh <- values
+
+			return values
+		})
+
+		assert.Equal(t, []string{
+			"https://token.actions.my-enterprise.ghe.com",
+			jwks,
+			`attribute.repository == "test/repo"`,
+		}, <-oidcCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryRepositoryOnAnotherServer(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			GitHubServerURL:           "https://github.example.com",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "is not on the GitHub server github.example.com")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCIProviders(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			CIProviders:               []string{"github", "gitlab", "bitbucket", "buildkite", "circleci"},
+			GitLabProjectIDs:          []string{"12345678", "23456789"},
+			BitbucketWorkspace:        "test-workspace",
+			BitbucketWorkspaceUUID:    "{0B4E0B7C-6D5C-4B8A-9F6E-2D3C4B5A6978}",
+			BitbucketRepositoryUUIDs:  []string{"1c2d3e4f-5a6b-4c7d-8e9f-0a1b2c3d4e5f"},
+			BuildkitePipelines:        []string{"test-org/service-c"},
+			CircleCIOrgID:             "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee",
+			CircleCIProjectIDs:        []string{"11111111-2222-3333-4444-555555555555"},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		require.Len(t, infra.OidcProviders, 5)
+		assert.Same(t, infra.OidcProviders["github"], infra.OidcProvider)
+
+		oidcCh := make(chan []string, 1)
+
+		pulumi.All(
+			infra.OidcProviders["gitlab"].Oidc.IssuerUri().Elem(),
+			infra.OidcProviders["gitlab"].AttributeCondition.Elem(),
+			infra.OidcProviders["bitbucket"].AttributeCondition.Elem(),
+			infra.OidcProviders["bitbucket"].Oidc.AllowedAudiences().Index(pulumi.Int(0)),
+			infra.OidcProviders["buildkite"].AttributeCondition.Elem(),
+			infra.OidcProviders["circleci"].Oidc.IssuerUri().Elem(),
+			infra.OidcProviders["circleci"].WorkloadIdentityPoolProviderId,
+		).ApplyT(func(args []interface{}) []string {
+			values := make([]string, 0, len(args))
+			for _, arg := range args {
+				values = append(values, arg.(string))
+			}
+			oidcCh <- values
+
+			return values
+		})
+
+		assert.Equal(t, []string{
+			"https://gitlab.com",
+			`attribute.gitlab_project_id in ["12345678", "23456789"]`,
+			`attribute.workspace_uuid == "{0b4e0b7c-6d5c-4b8a-9f6e-2d3c4b5a6978}" && attribute.repository_uuid == "{1c2d3e4f-5a6b-4c7d-8e9f-0a1b2c3d4e5f}"`,
+			"ari:cloud:bitbucket::workspace/0b4e0b7c-6d5c-4b8a-9f6e-2d3c4b5a6978",
+			`attribute.pipeline == "test-org/service-c"`,
+			"https://oidc.circleci.com/org/aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee",
+			"ci-circleci-provider",
+		}, <-oidcCh)
+
+		principalsCh := make(chan map[string]string, 1)
+
+		infra.RepositoryPrincipalIDs.ToStringMapOutput().ApplyT(func(principals map[string]string) map[string]string {
+			principalsCh <- principals
+
+			return principals
+		})
+
+		assert.Equal(t, map[string]string{
+			"test/repo":       "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/repo",
+			"gitlab:12345678": "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.gitlab_project_id/12345678",
+			"gitlab:23456789": "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.gitlab_project_id/23456789",
+			"bitbucket:{1c2d3e4f-5a6b-4c7d-8e9f-0a1b2c3d4e5f}": "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository_uuid/{1c2d3e4f-5a6b-4c7d-8e9f-0a1b2c3d4e5f}",
+			"buildkite:test-org/service-c":                     "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.pipeline/test-org/service-c",
+			"circleci:11111111-2222-3333-4444-555555555555":    "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.project_id/11111111-2222-3333-4444-555555555555",
+		}, <-principalsCh)
+
+		// Every pipeline gets the pipeline roles
+		assert.Len(t, infra.RepositoryIAMMembers, 6)
+		assert.Len(t, infra.SBOMBucketIAMMembers, 6)
+		assert.Len(t, infra.ProjectIAMMembers, 18)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryGitLabProjectPath(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			IdentityPoolProviderName: "github-actions-provider",
+			CIProviders:              []string{"gitlab"},
+			GitLabProjectIDs:         []string{"test-group/service-a"},
+		}
+
+		// Paths can be reclaimed by another project after a rename, only IDs are trusted
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid gitlab provider: project ID "test-group/service-a" must be the numeric ID of the project`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryEnvironmentTiersRequireGitHub(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			CIProviders:               []string{"gitlab"},
+			GitLabProjectIDs:          []string{"12345678"},
+			EnvironmentTiers:          []string{"dev", "prod"},
+			PromotionWorkflow:         ".github/workflows/promote.yml",
+			PromotionRef:              "refs/heads/main",
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ENVIRONMENT_TIERS require the github provider")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryPushRestrictionsWithOtherProviders(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			IdentityPoolProviderName:  "github-actions-provider",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			CIProviders:               []string{"github", "gitlab"},
+			GitLabProjectIDs:          []string{"12345678"},
+			AllowedRefs:               []string{"refs/heads/main"},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "push restrictions can't be combined with the gitlab provider")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCollidingProviderPrincipals(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			IdentityPoolProviderName:  "github-actions-provider",
+			AllowedRepoURLs:           []string{"https://github.com/test/repo", "https://github.com/gitlab/123"},
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			CIProviders:               []string{"github", "gitlab"},
+			GitLabProjectIDs:          []string{"123"},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `"gitlab/123" and "gitlab:123" can't both be trusted`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryEscapedAttributeCondition(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			RepositoryID:              `1" || attribute.repository != "`,
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		conditionCh := make(chan string, 1)
+
+		infra.OidcProvider.AttributeCondition.Elem().ApplyT(func(condition string) string {
+			conditionCh <- condition
+
+			return condition
+		})
+
+		// The quote is part of the repository ID rather than ending the string
+		assert.Equal(t, `attribute.repository == "test/repo" && attribute.repository_id == "1\" || attribute.repository != \""`, <-conditionCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryAttributeConditionTooLong(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		repoURLs := make([]string, 0, 200)
+		for i := range 200 {
+			repoURLs = append(repoURLs, fmt.Sprintf("https://github.com/test/service-with-a-long-name-%d", i))
+		}
+
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURLs:           repoURLs,
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "at most 4096 are allowed")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryRepositoryURLForms(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			AllowedRepoURLs: []string{
+				"git@github.com:test/repo-a.git",
+				"https://github.com/test/repo-b.git",
+				"HTTP://GitHub.com/test/Repo-C/",
+				"ssh://git@github.com/test/repo-d",
+				"test/repo-e",
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		conditionCh := make(chan string, 1)
+
+		infra.OidcProvider.AttributeCondition.Elem().ApplyT(func(condition string) string {
+			conditionCh <- condition
+
+			return condition
+		})
+
+		assert.Equal(t, `attribute.repository in ["test/repo-a", "test/repo-b", "test/Repo-C", "test/repo-d", "test/repo-e"]`, <-conditionCh)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryInvalidRepositoryURL(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo/tree/main",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `repository URL "https://github.com/test/repo/tree/main" must point to a repository`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryAllowedAudiences(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			AllowedAudiences:          []string{"https://github.com/test/production", "https://github.com/test/staging"},
+			EnforceAudience:           true,
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		valuesCh := make(chan []interface{}, 1)
+
+		pulumi.All(
+			infra.OidcProvider.Oidc.AllowedAudiences(),
+			infra.OidcProvider.AttributeCondition.Elem(),
+			infra.ExpectedAudience,
+		).ApplyT(func(args []interface{}) []interface{} {
+			valuesCh <- args
+
+			return args
+		})
+
+		values := <-valuesCh
+		assert.Equal(t, []string{"https://github.com/test/production", "https://github.com/test/staging"}, values[0])
+		assert.Equal(t, `attribute.repository == "test/repo" && attribute.aud in ["https://github.com/test/production", "https://github.com/test/staging"]`, values[1])
+		assert.Equal(t, "https://github.com/test/production", values[2])
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryTrustProfiles(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			TrustProfiles: ci.TrustProfileSpecs{
+				{
+					Name:            "release",
+					Refs:            []string{"refs/tags/v*"},
+					WorkflowRefs:    []string{"test/repo/.github/workflows/release.yml@refs/tags/*"},
+					RepositoryRoles: []string{"roles/artifactregistry.writer"},
+					ProjectRoles:    []string{"roles/containeranalysis.notes.editor"},
+					BucketRoles:     []string{"roles/storage.objectAdmin"},
+				},
+				{
+					Name:            "pr",
+					Events:          []string{"pull_request"},
+					RepositoryRoles: []string{"roles/artifactregistry.reader"},
+				},
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		mappingCh := make(chan map[string]string, 1)
+
+		infra.OidcProvider.AttributeMapping.ApplyT(func(mapping map[string]string) map[string]string {
+			mappingCh <- mapping
+
+			return mapping
+		})
+
+		mapping := <-mappingCh
+		assert.Equal(t,
+			`assertion.repository + ":" + (assertion.ref.matches("^refs/tags/v.*$") && `+
+				`assertion.workflow_ref.matches("^test/repo/\\.github/workflows/release\\.yml@refs/tags/.*$") ? "release" : `+
+				`(assertion.event_name == "pull_request" ? "pr" : "none"))`,
+			mapping["attribute.trust_profile"])
+
+		// Each profile gets its own roles instead of the default pipeline roles
+		assert.Len(t, infra.RepositoryIAMMembers, 2)
+		assert.Len(t, infra.ProjectIAMMembers, 1)
+		assert.Len(t, infra.SBOMBucketIAMMembers, 1)
+
+		principalsCh := make(chan map[string]string, 1)
+
+		infra.TrustProfilePrincipalIDs.ToStringMapOutput().ApplyT(func(principals map[string]string) map[string]string {
+			principalsCh <- principals
+
+			return principals
+		})
+
+		assert.Equal(t, map[string]string{
+			"test/repo:release": "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.trust_profile/test/repo:release",
+			"test/repo:pr":      "principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.trust_profile/test/repo:pr",
+		}, <-principalsCh)
+
+		release := testPool + "/attribute.trust_profile/test/repo:release"
+		pr := testPool + "/attribute.trust_profile/test/repo:pr"
+
+		repoGrants := repositoryGrants(infra.RepositoryIAMMembers)
+		projGrants := projectGrants(infra.ProjectIAMMembers)
+		sbomGrants := bucketGrants(infra.SBOMBucketIAMMembers)
+
+		assert.Equal(t, []iamGrant{
+			{role: "roles/artifactregistry.writer", member: release},
+			{role: "roles/artifactregistry.reader", member: pr},
+		}, repoGrants)
+		assert.Equal(t, []iamGrant{{role: "roles/containeranalysis.notes.editor", member: release}}, projGrants)
+		assert.Equal(t, []iamGrant{{role: "roles/storage.objectAdmin", member: release}}, sbomGrants)
+
+		// Workflows matching no profile get nothing, neither through the repository nor through the none profile
+		for _, grants := range [][]iamGrant{repoGrants, projGrants, sbomGrants} {
+			assert.NotContains(t, allMembers(grants), testRepoPrincipal)
+			assert.NotContains(t, allMembers(grants), testPool+"/attribute.trust_profile/test/repo:none")
+		}
+
+		// Pull request workflows can't push
+		assert.Equal(t, []string{release}, membersWithRole(repoGrants, "roles/artifactregistry.writer"))
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryTrustProfilesPullThroughCaches(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			RemoteCaches:             []string{"docker-hub"},
+			VirtualRepository:        true,
+			TrustProfiles: ci.TrustProfileSpecs{
+				{Name: "release", Refs: []string{"refs/tags/v*"}, RepositoryRoles: []string{"roles/artifactregistry.writer"}},
+				{Name: "audit", Events: []string{"schedule"}, ProjectRoles: []string{"roles/containeranalysis.occurrences.viewer"}},
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		release := testPool + "/attribute.trust_profile/test/repo:release"
+
+		// Only the profile with repository roles pulls, the workflows matching no profile get nothing
+		cacheGrants := repositoryGrants(infra.RemoteCacheIAMMembers)
+		virtualGrants := repositoryGrants(infra.VirtualRepositoryIAMMembers)
+
+		assert.Equal(t, []iamGrant{{role: "roles/artifactregistry.reader", member: release}}, cacheGrants)
+		assert.Equal(t, []iamGrant{{role: "roles/artifactregistry.reader", member: release}}, virtualGrants)
+
+		for _, grants := range [][]iamGrant{cacheGrants, virtualGrants, repositoryGrants(infra.RepositoryIAMMembers), projectGrants(infra.ProjectIAMMembers)} {
+			assert.NotContains(t, allMembers(grants), testRepoPrincipal)
+		}
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCatchAllTrustProfileMustBeLast(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			TrustProfiles: ci.TrustProfileSpecs{
+				{Name: "default", RepositoryRoles: []string{"roles/artifactregistry.reader"}},
+				{Name: "release", Refs: []string{"refs/tags/v*"}, RepositoryRoles: []string{"roles/artifactregistry.writer"}},
+			},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `trust profile "default" has no condition and must be the last one`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryServiceAccountAuthMode(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			AuthMode:                  ci.AuthModeServiceAccount,
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		require.NotNil(t, infra.GitHubActionsServiceAccount)
+		assert.Equal(t, ci.AuthModeServiceAccount, infra.AuthMode)
+
+		// The repository principal impersonates the service account
+		assert.Equal(t, []iamGrant{{role: "roles/iam.workloadIdentityUser", member: testRepoPrincipal}}, serviceAccountGrants(infra.ServiceAccountIAMMembers))
+
+		// Every pipeline role goes to the service account instead, none to the principal directly
+		saMember := "serviceAccount:ci-github-actions-sa@test-project.iam.gserviceaccount.com"
+
+		repoGrants := repositoryGrants(infra.RepositoryIAMMembers)
+		projGrants := projectGrants(infra.ProjectIAMMembers)
+		sbomGrants := bucketGrants(infra.SBOMBucketIAMMembers)
+
+		assert.Equal(t, []string{saMember}, membersWithRole(repoGrants, "roles/artifactregistry.writer"))
+		assert.Len(t, projGrants, 3)
+		assert.Equal(t, []string{saMember}, membersWithRole(sbomGrants, "roles/storage.objectAdmin"))
+
+		for _, grants := range [][]iamGrant{repoGrants, projGrants, sbomGrants} {
+			for _, member := range allMembers(grants) {
+				assert.Equal(t, saMember, member)
+			}
+		}
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryServiceAccountAuthModeWithPushRestrictions(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:               "test-project",
+			GCPRegion:                "us-central1",
+			RepositoryLocation:       "us",
+			ResourcePrefix:           "ci",
+			RepositoryName:           "registry",
+			AllowedRepoURL:           "https://github.com/test/repo",
+			IdentityPoolProviderName: "github-actions-provider",
+			AllowedRefs:              []string{"refs/heads/main"},
+			AuthMode:                 "service-account",
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "require the direct or both auth mode, so the workflows that can't push keep read access")
+
+		// In both modes, the workflows that can't push read directly and only the others impersonate the service account
+		config.AuthMode = "both"
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		writePrincipal := testPool + "/attribute.repository_access/test/repo:write"
+		assert.Equal(t, []string{writePrincipal}, membersWithRole(serviceAccountGrants(infra.ServiceAccountIAMMembers), "roles/iam.workloadIdentityUser"))
+
+		grants := repositoryGrants(infra.RepositoryIAMMembers)
+		assert.Equal(t, []string{testRepoPrincipal}, membersWithRole(grants, "roles/artifactregistry.reader"))
+		assert.NotContains(t, membersWithRole(grants, "roles/artifactregistry.writer"), testRepoPrincipal)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryCreateServiceAccountGrantsBoth(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			CreateServiceAccount:      true,
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		assert.Equal(t, ci.AuthModeBoth, infra.AuthMode)
+
+		// The repository principal and the service account hold the same roles
+		saMember := "serviceAccount:ci-github-actions-sa@test-project.iam.gserviceaccount.com"
+
+		for _, grants := range [][]iamGrant{
+			repositoryGrants(infra.RepositoryIAMMembers),
+			projectGrants(infra.ProjectIAMMembers),
+			bucketGrants(infra.SBOMBucketIAMMembers),
+		} {
+			for _, g := range grants {
+				assert.Contains(t, grants, iamGrant{role: g.role, member: testRepoPrincipal})
+				assert.Contains(t, grants, iamGrant{role: g.role, member: saMember})
+			}
+
+			assert.Len(t, membersWithRole(grants, grants[0].role), 2)
+		}
+
+		assert.Equal(t, []iamGrant{{role: "roles/iam.workloadIdentityUser", member: testRepoPrincipal}}, serviceAccountGrants(infra.ServiceAccountIAMMembers))
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryReaderMembers(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			RemoteCaches:              []string{"docker-hub"},
+			VirtualRepository:         true,
+			ReaderMembers: []string{
+				"serviceAgent:cloud-run:987654321098",
+				"group:deployers@partner.example.com",
+			},
+			Repositories: ci.RepositorySpecs{
+				{Name: "registry", Readers: []string{"group:deployers@partner.example.com"}},
+			},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"serviceAccount:service-987654321098@serverless-robot-prod.iam.gserviceaccount.com",
+			"group:deployers@partner.example.com",
+		}, infra.ReaderMembers)
+
+		cloudRun := "serviceAccount:service-987654321098@serverless-robot-prod.iam.gserviceaccount.com"
+		group := "group:deployers@partner.example.com"
+
+		// Pull access on the registry, the cache and the virtual repository. The group already reads the registry.
+		readerGrants := repositoryGrants(infra.ReaderIAMMembers)
+		assert.Equal(t, []string{cloudRun, cloudRun, group, cloudRun, group}, membersWithRole(readerGrants, "roles/artifactregistry.reader"))
+		assert.Len(t, readerGrants, 5)
+
+		// Readers never get write access
+		for _, grants := range [][]iamGrant{readerGrants, repositoryGrants(infra.RepositoryIAMMembers), repositoryGrants(infra.RemoteCacheIAMMembers)} {
+			assert.NotContains(t, membersWithRole(grants, "roles/artifactregistry.writer"), cloudRun)
+			assert.NotContains(t, membersWithRole(grants, "roles/artifactregistry.writer"), group)
+		}
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryUnknownServiceAgent(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			ReaderMembers:             []string{"serviceAgent:app-engine:987654321098"},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `unknown service agent "app-engine"`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistrySBOMCustomRole(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			SBOMRole:                  ci.SBOMRoleCustom,
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		require.NotNil(t, infra.SBOMCustomRole)
+
+		permissionsCh := make(chan []string, 1)
+
+		infra.SBOMCustomRole.Permissions.ApplyT(func(permissions []string) []string {
+			permissionsCh <- permissions
+
+			return permissions
+		})
+
+		permissions := <-permissionsCh
+		assert.Contains(t, permissions, "containeranalysis.occurrences.create")
+		assert.NotContains(t, permissions, "containeranalysis.notes.delete")
+		assert.NotContains(t, permissions, "containeranalysis.occurrences.update")
+
+		// The custom role replaces the predefined Container Analysis and bucket viewer roles
+		grants := projectGrants(infra.ProjectIAMMembers)
+		assert.Equal(t, []iamGrant{{role: "projects/test-project/roles/ci_sbom_publisher", member: testRepoPrincipal}}, grants)
+		assert.Empty(t, membersWithRole(grants, "roles/containeranalysis.notes.editor"))
+		assert.Empty(t, membersWithRole(grants, "roles/containeranalysis.occurrences.editor"))
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistrySBOMRoleMigration(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			SBOMRole:                  ci.SBOMRoleBoth,
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		require.NotNil(t, infra.SBOMCustomRole)
+
+		// The predefined roles keep their bindings until the custom role takes over
+		assert.Equal(t, []iamGrant{
+			{role: "roles/containeranalysis.notes.editor", member: testRepoPrincipal},
+			{role: "roles/containeranalysis.occurrences.editor", member: testRepoPrincipal},
+			{role: "roles/storage.bucketViewer", member: testRepoPrincipal},
+			{role: "projects/test-project/roles/ci_sbom_publisher", member: testRepoPrincipal},
+		}, projectGrants(infra.ProjectIAMMembers))
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistrySBOMCustomRoleKeptInLegacyMode(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			SBOMRole:                  ci.SBOMRoleLegacy,
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+
+		// The role outlives the switch to legacy, so its ID can be bound again, but nothing is granted it
+		require.NotNil(t, infra.SBOMCustomRole)
+
+		grants := projectGrants(infra.ProjectIAMMembers)
+		assert.Equal(t, []string{testRepoPrincipal}, membersWithRole(grants, "roles/containeranalysis.notes.editor"))
+		assert.Empty(t, membersWithRole(grants, "projects/test-project/roles/ci_sbom_publisher"))
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryProjectIAMConditions(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			SBOMRole:                  "both",
+			ScopeProjectIAM:           true,
+			ProjectIAMExpiry:          "2026-12-31T00:00:00Z",
+			ExtraProjectRoles:         []string{"roles/cloudbuild.builds.viewer=group:platform@example.com"},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		require.Len(t, infra.ProjectIAMMembers, 5)
+
+		// Member overrides are not the pipeline, they are granted without a condition
+		override := infra.ProjectIAMMembers[0]
+		unconditionedCh := make(chan bool, 1)
+
+		override.Condition.ApplyT(func(condition *projects.IAMMemberCondition) bool {
+			unconditionedCh <- condition == nil
+
+			return condition == nil
+		})
+
+		assert.True(t, <-unconditionedCh)
+		assert.Equal(t, []iamGrant{{role: "roles/cloudbuild.builds.viewer", member: "group:platform@example.com"}}, projectGrants(infra.ProjectIAMMembers[:1]))
+
+		pipelineMembers := infra.ProjectIAMMembers[1:]
+
+		type condition struct {
+			title      string
+			expression string
+		}
+
+		conditions := make([]condition, 0, len(pipelineMembers))
+		conditionCh := make(chan condition, 1)
+
+		for _, member := range pipelineMembers {
+			pulumi.All(member.Condition.Title().Elem(), member.Condition.Expression().Elem()).ApplyT(func(args []interface{}) condition {
+				c := condition{title: args[0].(string), expression: args[1].(string)}
+				conditionCh <- c
+
+				return c
+			})
+
+			conditions = append(conditions, <-conditionCh)
+		}
+
+		expiry := `request.time < timestamp("2026-12-31T00:00:00Z")`
+		bucket := `resource.name == "projects/_/buckets/artifacts-test-project-sbom"`
+
+		// Container Analysis has no resource attributes, so its roles only expire
+		assert.Equal(t, []condition{
+			{title: "ci-pipeline-expiry-containeranalysis.notes.editor", expression: expiry},
+			{title: "ci-pipeline-expiry-containeranalysis.occurrences.editor", expression: expiry},
+			{title: "ci-pipeline-scope-storage.bucketViewer", expression: `(resource.type == "storage.googleapis.com/Bucket" && ` + bucket + `) && ` + expiry},
+			{title: "ci-pipeline-scope-sbom-publisher", expression: `(resource.type != "storage.googleapis.com/Bucket" || ` + bucket + `) && ` + expiry},
+		}, conditions)
+
+		// Every project binding of the pipeline is conditional, none grants the roles outside the condition
+		assert.Equal(t, []string{testRepoPrincipal, testRepoPrincipal, testRepoPrincipal, testRepoPrincipal}, allMembers(projectGrants(pipelineMembers)))
+
+		for _, c := range conditions {
+			assert.Contains(t, c.expression, expiry, c.title)
+		}
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryInvalidProjectIAMExpiry(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			ProjectIAMExpiry:          "2026-12-31",
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "PROJECT_IAM_EXPIRY must be an RFC 3339 timestamp")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryExtraRoles(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			ExtraRepositoryRoles:      []string{"roles/artifactregistry.repoAdmin=group:platform@example.com"},
+			ExtraProjectRoles:         []string{"roles/cloudbuild.builds.editor"},
+			ExtraBucketRoles:          []string{"roles/storage.objectViewer=group:security@example.com"},
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		repoGrants := repositoryGrants(infra.RepositoryIAMMembers)
+		projGrants := projectGrants(infra.ProjectIAMMembers)
+		sbomGrants := bucketGrants(infra.SBOMBucketIAMMembers)
+
+		assert.Equal(t, []iamGrant{
+			{role: "roles/artifactregistry.writer", member: testRepoPrincipal},
+			{role: "roles/artifactregistry.repoAdmin", member: "group:platform@example.com"},
+		}, repoGrants)
+		assert.Equal(t, []string{testRepoPrincipal}, membersWithRole(projGrants, "roles/cloudbuild.builds.editor"))
+		assert.Len(t, projGrants, 4)
+		assert.Equal(t, []iamGrant{
+			{role: "roles/storage.objectAdmin", member: testRepoPrincipal},
+			{role: "roles/storage.objectViewer", member: "group:security@example.com"},
+		}, sbomGrants)
+
+		// Member overrides replace the pipeline for their role, and get nothing else
+		assert.NotContains(t, allMembers(projGrants), "group:platform@example.com")
+		assert.NotContains(t, allMembers(projGrants), "group:security@example.com")
+		assert.NotContains(t, membersWithRole(repoGrants, "roles/artifactregistry.repoAdmin"), testRepoPrincipal)
+
+		// Bindings are named after the role and the member, not their position
+		urnCh := make(chan string, 1)
+
+		infra.RepositoryIAMMembers[1].URN().ApplyT(func(urn string) string {
+			urnCh <- urn
+
+			return urn
+		})
+
+		assert.Contains(t, <-urnCh, "::ci-repo-iam-roles/artifactregistry.repoAdmin-extra-group-platform-example.com")
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistryInvalidExtraRole(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+			ExtraProjectRoles:         []string{"owner"},
+		}
+
+		_, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `invalid EXTRA_PROJECT_ROLES: role "owner" must be a predefined (roles/...) or custom role`)
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
+
+func TestNewGithubGoogleRegistrySeparateProjects(t *testing.T) {
+	t.Parallel()
+
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		config := &ci.Config{
+			GCPProject:                "test-project",
+			IdentityProject:           "security-project",
+			RegistryProject:           "team-project",
+			SBOMBucketProject:         "artifacts-project",
+			GCPRegion:                 "us-central1",
+			RepositoryLocation:        "us",
+			ResourcePrefix:            "ci",
+			RepositoryName:            "registry",
+			AllowedRepoURL:            "https://github.com/test/repo",
+			IdentityPoolProviderName:  "github-actions-provider",
+			RecentImageRetentionCount: 10,
+			OldImageDeletionDays:      "30d",
+		}
+
+		infra, err := ci.NewGithubGoogleRegistry(ctx, config)
+		require.NoError(t, err)
+		require.Len(t, infra.ProjectIAMMembers, 3)
+
+		projectsCh := make(chan []string, 1)
+
+		pulumi.All(
+			infra.WorkloadIdentityPool.Project,
+			infra.OidcProvider.Project,
+			infra.Repositories["registry"].Project,
+			infra.SBOMBucket.Project,
+			infra.SBOMBucket.Name,
+			infra.ProjectIAMMembers[0].Project,
+			infra.ProjectIAMMembers[2].Role,
+			infra.ProjectIAMMembers[2].Project,
+		).ApplyT(func(args []interface{}) []string {
+			values := make([]string, 0, len(args))
+			for _, arg := range args {
+				values = append(values, arg.(string))
+			}
+			projectsCh <- values
+
+			return values
+		})
+
+		assert.Equal(t, []string{
+			"security-project",
+			"security-project",
+			"team-project",
+			"artifacts-project",
+			"artifacts-artifacts-project-sbom",
+			"team-project",
+			"roles/storage.bucketViewer",
+			"artifacts-project",
+		}, <-projectsCh)
+
+		// Principals and the provider ID hold the number of the identity project
+		idsCh := make(chan []string, 1)
+
+		pulumi.All(infra.RepositoryPrincipalID, infra.WorkloadIdentityPoolProviderID).ApplyT(func(args []interface{}) []string {
+			ids := []string{args[0].(string), args[1].(string)}
+			idsCh <- ids
+
+			return ids
+		})
+
+		ids := <-idsCh
+		assert.Equal(t, "principalSet://iam.googleapis.com/projects/210987654321/locations/global/workloadIdentityPools/ci-github-actions-pool/attribute.repository/test/repo", ids[0])
+		assert.Equal(t, "projects/210987654321/locations/global/workloadIdentityPools/ci-github-actions-pool/providers/ci-github-actions-provider", ids[1])
+
+		// Every binding goes to the identity project principal, none to a principal of the registry project's pool
+		for _, grants := range [][]iamGrant{
+			repositoryGrants(infra.RepositoryIAMMembers),
+			projectGrants(infra.ProjectIAMMembers),
+			bucketGrants(infra.SBOMBucketIAMMembers),
+		} {
+			require.NotEmpty(t, grants)
+
+			for _, member := range allMembers(grants) {
+				assert.Equal(t, ids[0], member)
+			}
+		}
+
+		return nil
+	}, pulumi.WithMocks("project", "stack", &infraMocks{}))
+
+	if err != nil {
+		t.Fatalf("Pulumi WithMocks failed: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/secretmanager"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// dockerHubUpstream is the Artifact Registry identifier for the Docker Hub public repository
+const dockerHubUpstream = "DOCKER_HUB"
+
+// remoteCachePresets are the well-known upstream registries that can be cached by name
+var remoteCachePresets = map[string]string{
+	"docker-hub": dockerHubUpstream,
+	"ghcr":       "https://ghcr.io",
+	"quay":       "https://quay.io",
+}
+
+var remoteCacheNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,30}$`)
+
+// remoteCache is an upstream registry mirrored through a pull-through cache repository
+type remoteCache struct {
+	name string
+	// DOCKER_HUB or the URI of a custom upstream registry
+	upstream string
+	username string
+	password string
+}
+
+func (c remoteCache) hasCredentials() bool {
+	return c.username != ""
+}
+
+// parseRemoteCaches resolves the configured remote caches and their upstream credentials
+func parseRemoteCaches(config *Config) ([]remoteCache, error) {
+	caches := make([]remoteCache, 0, len(config.RemoteCaches))
+	seen := map[string]bool{}
+
+	for _, entry := range config.RemoteCaches {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Either a preset name or name=https://custom.registry
+		name, upstream, custom := strings.Cut(entry, "=")
+		if !custom {
+			preset, ok := remoteCachePresets[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown remote cache %q, use one of docker-hub, ghcr, quay or name=https://registry.example.com", name)
+			}
+
+			upstream = preset
+		} else if !strings.HasPrefix(upstream, "https://") {
+			return nil, fmt.Errorf("remote cache %q upstream must be an https:// URI, got %q", name, upstream)
+		}
+
+		if !remoteCacheNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("remote cache name %q must be lowercase letters, digits and hyphens", name)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("remote cache %q is configured more than once", name)
+		}
+
+		seen[name] = true
+
+		username := config.RemoteCacheUsernames[name]
+		password := config.RemoteCachePasswords[name]
+
+		if (username == "") != (password == "") {
+			return nil, fmt.Errorf("remote cache %q requires both a username and a password", name)
+		}
+
+		caches = append(caches, remoteCache{
+			name:     name,
+			upstream: upstream,
+			username: username,
+			password: password,
+		})
+	}
+
+	for name := range config.RemoteCacheUsernames {
+		if !seen[name] {
+			return nil, fmt.Errorf("upstream credentials configured for unknown remote cache %q", name)
+		}
+	}
+
+	for name := range config.RemoteCachePasswords {
+		if !seen[name] {
+			return nil, fmt.Errorf("upstream credentials configured for unknown remote cache %q", name)
+		}
+	}
+
+	return caches, nil
+}
+
+// deployRemoteCaches creates a pull-through cache repository per upstream registry and grants pull access to the pipeline
+func (r *GithubGoogleRegistry) deployRemoteCaches(ctx *pulumi.Context, caches []remoteCache, projectNumber pulumi.StringOutput, principals []pipelinePrincipal, encryption *encryptionKeys, repositoryDependencies []pulumi.Resource) error {
+	if len(caches) == 0 {
+		return nil
+	}
+
+	dockerFormat := repositoryFormats[FormatDocker]
+
+	var secretManagerAPI *projects.Service
+
+	r.RemoteCacheRepositories = make([]*artifactregistry.Repository, 0, len(caches))
+	r.RemoteCacheURLs = pulumi.StringMap{}
+
+	for _, cache := range caches {
+		dependencies := append([]pulumi.Resource{}, repositoryDependencies...)
+
+		dockerRepository := &artifactregistry.RepositoryRemoteRepositoryConfigDockerRepositoryArgs{}
+		if cache.upstream == dockerHubUpstream {
+			dockerRepository.PublicRepository = pulumi.String(dockerHubUpstream)
+		} else {
+			dockerRepository.CustomRepository = &artifactregistry.RepositoryRemoteRepositoryConfigDockerRepositoryCustomRepositoryArgs{
+				Uri: pulumi.String(cache.upstream),
+			}
+		}
+
+		remoteConfig := &artifactregistry.RepositoryRemoteRepositoryConfigArgs{
+			Description:      pulumi.Sprintf("Pull-through cache for %s", cache.upstream),
+			DockerRepository: dockerRepository,
+		}
+
+		if cache.hasCredentials() {
+			if secretManagerAPI == nil {
+				var err error
+
+				secretManagerAPI, err = r.enableRegistryAPI(ctx, "secretmanager", "secretmanager.googleapis.com")
+				if err != nil {
+					return fmt.Errorf("failed to enable Secret Manager API: %w", err)
+				}
+			}
+
+			passwordVersion, secretAccessor, err := r.newUpstreamPasswordSecret(ctx, cache, projectNumber, secretManagerAPI)
+			if err != nil {
+				return err
+			}
+
+			remoteConfig.UpstreamCredentials = &artifactregistry.RepositoryRemoteRepositoryConfigUpstreamCredentialsArgs{
+				UsernamePasswordCredentials: &artifactregistry.RepositoryRemoteRepositoryConfigUpstreamCredentialsUsernamePasswordCredentialsArgs{
+					Username:              pulumi.String(cache.username),
+					PasswordSecretVersion: passwordVersion.Name,
+				},
+			}
+
+			// The registry service agent must be able to read the password before the first pull
+			dependencies = append(dependencies, secretAccessor)
+		}
+
+		repository, err := artifactregistry.NewRepository(ctx, r.NewResourceName(cache.name, "cache-repo", 63), &artifactregistry.RepositoryArgs{
+			RepositoryId: pulumi.String(r.NewResourceName(cache.name, "cache", 63)),
+			Location:     pulumi.String(r.config.RepositoryLocation),
+			Project:      pulumi.String(r.config.registryProject()),
+			Description:  pulumi.Sprintf("CI/CD pull-through cache for %s", cache.name),
+			Format:       pulumi.String(FormatDocker),
+			Mode:         pulumi.String("REMOTE_REPOSITORY"),
+			Labels: pulumi.StringMap{
+				"managed-by": pulumi.String("pulumi"),
+				"purpose":    pulumi.String("docker-cache"),
+			},
+			RemoteRepositoryConfig: remoteConfig,
+			// Cached upstream images always use the default retention, CLEANUP_POLICIES only applies to the managed repositories
+			CleanupPolicies:     newCleanupPolicies(dockerFormat, r.config.RecentImageRetentionCount, r.config.OldImageDeletionDays, false),
+			CleanupPolicyDryRun: pulumi.Bool(r.config.CleanupPolicyDryRun),
+			KmsKeyName:          encryption.repository,
+			// Cached images are scanned like the ones pushed by the pipeline
+			VulnerabilityScanningConfig: newVulnerabilityScanningConfig(r.config.VulnerabilityScanning),
+		},
+			pulumi.Parent(r),
+			pulumi.Protect(r.config.ProtectResources),
+			pulumi.DependsOn(dependencies),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to create remote repository for %s: %w", cache.name, err)
+		}
+
+		// Pull access for the pipeline
+		for _, principal := range pullPrincipals(principals) {
+			member, err := artifactregistry.NewRepositoryIamMember(ctx, principal.bindingName(fmt.Sprintf("%s-%s-cache-iam-roles/artifactregistry.reader", r.config.ResourcePrefix, cache.name)), &artifactregistry.RepositoryIamMemberArgs{
+				Repository: repository.Name,
+				Location:   pulumi.String(r.config.RepositoryLocation),
+				Project:    pulumi.String(r.config.registryProject()),
+				Role:       pulumi.String("roles/artifactregistry.reader"),
+				Member:     principal.id,
+			}, pulumi.Parent(r))
+			if err != nil {
+				return fmt.Errorf("failed to create remote repository IAM member for %s: %w", cache.name, err)
+			}
+
+			r.RemoteCacheIAMMembers = append(r.RemoteCacheIAMMembers, member)
+		}
+
+		r.RemoteCacheRepositories = append(r.RemoteCacheRepositories, repository)
+		r.RemoteCacheURLs[cache.name] = dockerFormat.endpoint(r.config.RepositoryLocation, r.config.registryProject(), repository.RepositoryId)
+	}
+
+	return nil
+}
+
+// newUpstreamPasswordSecret stores the upstream password in Secret Manager and lets the Artifact Registry service agent read it
+func (r *GithubGoogleRegistry) newUpstreamPasswordSecret(ctx *pulumi.Context, cache remoteCache, projectNumber pulumi.StringOutput, secretManagerAPI *projects.Service) (*secretmanager.SecretVersion, *secretmanager.SecretIamMember, error) {
+	secretID := r.NewResourceName(cache.name, "upstream-password", 63)
+
+	secret, err := secretmanager.NewSecret(ctx, secretID, &secretmanager.SecretArgs{
+		SecretId: pulumi.String(secretID),
+		Project:  pulumi.String(r.config.registryProject()),
+		Replication: &secretmanager.SecretReplicationArgs{
+			Auto: &secretmanager.SecretReplicationAutoArgs{},
+		},
+		Labels: pulumi.StringMap{
+			"managed-by": pulumi.String("pulumi"),
+			"purpose":    pulumi.String("docker-cache-credentials"),
+		},
+	},
+		pulumi.Parent(r),
+		pulumi.DependsOn([]pulumi.Resource{secretManagerAPI}),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create upstream password secret for %s: %w", cache.name, err)
+	}
+
+	version, err := secretmanager.NewSecretVersion(ctx, r.NewResourceName(cache.name, "upstream-password-version", 63), &secretmanager.SecretVersionArgs{
+		Secret:     secret.ID(),
+		SecretData: pulumi.ToSecret(pulumi.String(cache.password)).(pulumi.StringOutput),
+	}, pulumi.Parent(r))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create upstream password secret version for %s: %w", cache.name, err)
+	}
+
+	accessor, err := secretmanager.NewSecretIamMember(ctx, fmt.Sprintf("%s-%s-upstream-password-accessor", r.config.ResourcePrefix, cache.name), &secretmanager.SecretIamMemberArgs{
+		Project:  pulumi.String(r.config.registryProject()),
+		SecretId: secret.SecretId,
+		Role:     pulumi.String("roles/secretmanager.secretAccessor"),
+		Member:   pulumi.Sprintf("serviceAccount:service-%s@gcp-sa-artifactregistry.iam.gserviceaccount.com", projectNumber),
+	}, pulumi.Parent(r))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to grant registry service agent access to upstream password for %s: %w", cache.name, err)
+	}
+
+	return version, accessor, nil
+}
@@ -0,0 +1,307 @@
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Access the pipeline principal gets on a repository
+const (
+	PipelineAccessWriter = "writer"
+	PipelineAccessReader = "reader"
+	PipelineAccessNone   = "none"
+)
+
+var (
+	repositoryNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,49}$`)
+	memberKeyPattern      = regexp.MustCompile(`[^a-z0-9.-]+`)
+)
+
+// RepositorySpec describes a standard repository managed by the component
+type RepositorySpec struct {
+	Name string `json:"name"`
+	// Defaults to DOCKER
+	Format      string            `json:"format,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Overrides RECENT_IMAGE_RETENTION_COUNT for this repository
+	RecentVersionRetentionCount int `json:"recentVersionRetentionCount,omitempty"`
+	// Overrides OLD_IMAGE_DELETION_DAYS for this repository
+	OldVersionDeletionAge string `json:"oldVersionDeletionAge,omitempty"`
+	// Overrides IMMUTABLE_TAGS for this repository. Docker only.
+	ImmutableTags *bool `json:"immutableTags,omitempty"`
+	// Overrides CLEANUP_POLICIES for this repository. An empty list disables cleanup.
+	CleanupPolicies CleanupPolicySpecs `json:"cleanupPolicies,omitempty"`
+	// Overrides CLEANUP_POLICY_DRY_RUN for this repository
+	CleanupPolicyDryRun *bool `json:"cleanupPolicyDryRun,omitempty"`
+	// Overrides VULNERABILITY_SCANNING for this repository
+	VulnerabilityScanning string `json:"vulnerabilityScanning,omitempty"`
+	// Access for the pipeline principal: writer (default), reader or none
+	PipelineAccess string `json:"pipelineAccess,omitempty"`
+	// Additional IAM members with write access (e.g. serviceAccount:builder@my-project.iam.gserviceaccount.com)
+	Writers []string `json:"writers,omitempty"`
+	// Additional IAM members with read access
+	Readers []string `json:"readers,omitempty"`
+}
+
+// RepositorySpecs is a list of repository specs, decoded from a JSON array when loaded from the environment
+type RepositorySpecs []RepositorySpec
+
+// Decode implements envconfig.Decoder
+func (s *RepositorySpecs) Decode(value string) error {
+	return json.Unmarshal([]byte(value), (*[]RepositorySpec)(s))
+}
+
+// managedRepository is a repository spec with the component defaults applied
+type managedRepository struct {
+	name        string
+	format      repositoryFormat
+	description string
+	labels      map[string]string
+	keepCount   int
+	olderThan   string
+	// prevents tags from being moved or deleted, Docker only
+	immutableTags bool
+	// replaces the default keep and delete policies when not nil
+	cleanupPolicies CleanupPolicySpecs
+	cleanupDryRun   bool
+	// enabled, disabled or inherited
+	vulnerabilityScanning string
+	// repository role for the pipeline principal, empty for no access
+	pipelineRole string
+	// repository role for the promotion workflow principal, empty for no access
+	promotionRole string
+	// environment tier served by the repository, empty for regular repositories
+	tier    string
+	writers []string
+	readers []string
+	// The repository named after REPOSITORY_NAME keeps the IAM binding names it had
+	// before multiple repositories were supported, so upgrading causes no churn.
+	legacyNames bool
+
+	repository *artifactregistry.Repository
+}
+
+// resolveRepositories returns the repositories to manage. Without REPOSITORIES, the single
+// repository described by REPOSITORY_NAME and REPOSITORY_FORMAT is managed, unless environment
+// tiers replace it: every workflow could push to it, bypassing promotion.
+func resolveRepositories(config *Config) ([]*managedRepository, error) {
+	specs := config.Repositories
+
+	explicit := len(specs) > 0
+	if !explicit && len(config.EnvironmentTiers) == 0 {
+		specs = RepositorySpecs{{
+			Name:   config.RepositoryName,
+			Format: config.RepositoryFormat,
+		}}
+	}
+
+	repositories := make([]*managedRepository, 0, len(specs))
+	seen := map[string]bool{}
+
+	for _, spec := range specs {
+		// REPOSITORY_NAME predates this check and is sanitized by the namer instead
+		if explicit && !repositoryNamePattern.MatchString(spec.Name) {
+			return nil, fmt.Errorf("repository name %q must start with a letter and contain only lowercase letters, digits and hyphens", spec.Name)
+		}
+
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("repository %q is configured more than once", spec.Name)
+		}
+
+		seen[spec.Name] = true
+
+		format, err := lookupRepositoryFormat(spec.Format)
+		if err != nil {
+			return nil, fmt.Errorf("repository %q: %w", spec.Name, err)
+		}
+
+		pipelineRole, err := pipelineRepositoryRole(spec.PipelineAccess)
+		if err != nil {
+			return nil, fmt.Errorf("repository %q: %w", spec.Name, err)
+		}
+
+		if spec.ImmutableTags != nil && *spec.ImmutableTags && format.name != FormatDocker {
+			return nil, fmt.Errorf("repository %q: immutable tags are only supported for %s repositories", spec.Name, FormatDocker)
+		}
+
+		for _, member := range append(append([]string{}, spec.Writers...), spec.Readers...) {
+			if !strings.Contains(member, ":") {
+				return nil, fmt.Errorf("repository %q: member %q must be prefixed with its type (e.g. serviceAccount:, group:, principalSet:)", spec.Name, member)
+			}
+		}
+
+		cleanupPolicies := config.CleanupPolicies
+		if spec.CleanupPolicies != nil {
+			cleanupPolicies = spec.CleanupPolicies
+		}
+
+		cleanupPolicies, err = normalizeCleanupPolicies(cleanupPolicies)
+		if err != nil {
+			return nil, fmt.Errorf("repository %q: %w", spec.Name, err)
+		}
+
+		vulnerabilityScanning := config.VulnerabilityScanning
+		if spec.VulnerabilityScanning != "" {
+			vulnerabilityScanning = spec.VulnerabilityScanning
+		}
+
+		vulnerabilityScanning, err = lookupVulnerabilityScanning(vulnerabilityScanning)
+		if err != nil {
+			return nil, fmt.Errorf("repository %q: %w", spec.Name, err)
+		}
+
+		repository := &managedRepository{
+			name:         spec.Name,
+			format:       format,
+			description:  format.description,
+			keepCount:    config.RecentImageRetentionCount,
+			olderThan:    config.OldImageDeletionDays,
+			pipelineRole: pipelineRole,
+			writers:      spec.Writers,
+			readers:      spec.Readers,
+			legacyNames:  spec.Name == config.RepositoryName,
+			// Other formats have no tags to protect
+			immutableTags:         config.ImmutableTags && format.name == FormatDocker,
+			cleanupPolicies:       cleanupPolicies,
+			cleanupDryRun:         config.CleanupPolicyDryRun,
+			vulnerabilityScanning: vulnerabilityScanning,
+			labels: map[string]string{
+				"purpose": format.purpose,
+			},
+		}
+
+		if spec.Description != "" {
+			repository.description = spec.Description
+		}
+
+		if spec.RecentVersionRetentionCount > 0 {
+			repository.keepCount = spec.RecentVersionRetentionCount
+		}
+
+		if spec.ImmutableTags != nil {
+			repository.immutableTags = *spec.ImmutableTags
+		}
+
+		if repository.immutableTags {
+			err = validateImmutableCleanupPolicies(repository.cleanupPolicies)
+			if err != nil {
+				return nil, fmt.Errorf("repository %q: %w", spec.Name, err)
+			}
+		}
+
+		if spec.CleanupPolicyDryRun != nil {
+			repository.cleanupDryRun = *spec.CleanupPolicyDryRun
+		}
+
+		if spec.OldVersionDeletionAge != "" {
+			repository.olderThan = spec.OldVersionDeletionAge
+		}
+
+		for key, value := range spec.Labels {
+			repository.labels[key] = value
+		}
+
+		repository.labels["managed-by"] = "pulumi"
+
+		repositories = append(repositories, repository)
+	}
+
+	tiers, err := resolveEnvironmentTiers(config, seen)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(repositories, tiers...), nil
+}
+
+func pipelineRepositoryRole(access string) (string, error) {
+	switch access {
+	case "", PipelineAccessWriter:
+		return "roles/artifactregistry.writer", nil
+	case PipelineAccessReader:
+		return "roles/artifactregistry.reader", nil
+	case PipelineAccessNone:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unknown pipeline access %q, must be one of: writer, reader, none", access)
+	}
+}
+
+// deployRepository creates the Artifact Registry repository for a spec
+func (r *GithubGoogleRegistry) deployRepository(ctx *pulumi.Context, repository *managedRepository, encryption *encryptionKeys, dependencies []pulumi.Resource) error {
+	repoResourceName := r.NewResourceName(repository.name, "repo", 63)
+	// The input controls the ID, we just make sure it's valid
+	repositoryID := r.NewResourceName(repository.name, "", 63)
+
+	var dockerConfig *artifactregistry.RepositoryDockerConfigArgs
+	if repository.format.name == FormatDocker {
+		dockerConfig = &artifactregistry.RepositoryDockerConfigArgs{
+			ImmutableTags: pulumi.Bool(repository.immutableTags),
+		}
+	}
+
+	registry, err := artifactregistry.NewRepository(ctx, repoResourceName, &artifactregistry.RepositoryArgs{
+		RepositoryId:                pulumi.String(repositoryID),
+		Location:                    pulumi.String(r.config.RepositoryLocation),
+		Project:                     pulumi.String(r.config.registryProject()),
+		Description:                 pulumi.String(repository.description),
+		Format:                      pulumi.String(repository.format.name),
+		Labels:                      pulumi.ToStringMap(repository.labels),
+		DockerConfig:                dockerConfig,
+		CleanupPolicies:             repository.newCleanupPolicies(),
+		CleanupPolicyDryRun:         pulumi.Bool(repository.cleanupDryRun),
+		KmsKeyName:                  encryption.repository,
+		VulnerabilityScanningConfig: newVulnerabilityScanningConfig(repository.vulnerabilityScanning),
+	},
+		pulumi.Parent(r),
+		pulumi.Protect(r.config.ProtectResources),
+		pulumi.DependsOn(dependencies),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create artifact registry repository %s: %w", repository.name, err)
+	}
+
+	repository.repository = registry
+
+	return nil
+}
+
+// newCleanupPolicies returns the configured cleanup policies, or the defaults derived from the retention settings
+func (m *managedRepository) newCleanupPolicies() artifactregistry.RepositoryCleanupPolicyArray {
+	if m.cleanupPolicies != nil {
+		return newCustomCleanupPolicies(m.cleanupPolicies)
+	}
+
+	return newCleanupPolicies(m.format, m.keepCount, m.olderThan, m.immutableTags)
+}
+
+// url returns the endpoint clients use for the deployed repository
+func (m *managedRepository) url(config *Config) pulumi.StringOutput {
+	return m.format.endpoint(config.RepositoryLocation, config.registryProject(), m.repository.RepositoryId)
+}
+
+// iamBindingName returns a stable resource name for a repository IAM binding. The key tells apart
+// the members sharing a role and is empty for the pipeline principal.
+func (m *managedRepository) iamBindingName(prefix, role, key string) string {
+	name := fmt.Sprintf("%s-%s-repo-iam-%s", prefix, m.name, role)
+	if m.legacyNames {
+		name = fmt.Sprintf("%s-repo-iam-%s", prefix, role)
+	}
+
+	if key != "" {
+		name = fmt.Sprintf("%s-%s", name, key)
+	}
+
+	return name
+}
+
+// memberKey turns an IAM member into a readable, stable resource name suffix
+func memberKey(member string) string {
+	return strings.Trim(memberKeyPattern.ReplaceAllString(strings.ToLower(member), "-"), "-")
+}
@@ -0,0 +1,90 @@
+package ci
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// extraRole is an additional role granted to the pipeline, or to the member overriding it
+type extraRole struct {
+	role string
+	// IAM member granted the role instead of the pipeline, empty for the pipeline
+	member string
+}
+
+// parseExtraRoles parses role or role=member entries, e.g. roles/artifactregistry.repoAdmin=group:platform@example.com
+func parseExtraRoles(entries []string) ([]extraRole, error) {
+	roles := make([]extraRole, 0, len(entries))
+	seen := map[extraRole]bool{}
+
+	for _, entry := range entries {
+		role, member, _ := strings.Cut(strings.TrimSpace(entry), "=")
+
+		if !iamRolePattern.MatchString(role) {
+			return nil, fmt.Errorf("role %q must be a predefined (roles/...) or custom role", role)
+		}
+
+		if member != "" && !strings.Contains(member, ":") {
+			return nil, fmt.Errorf("member %q of role %s must be prefixed with its type (e.g. serviceAccount:, group:, principalSet:)", member, role)
+		}
+
+		extra := extraRole{role: role, member: member}
+		if seen[extra] {
+			return nil, fmt.Errorf("role %q is configured more than once", entry)
+		}
+
+		seen[extra] = true
+
+		roles = append(roles, extra)
+	}
+
+	return roles, nil
+}
+
+// validateExtraRoles checks the additional repository, project and bucket roles
+func validateExtraRoles(config *Config) error {
+	settings := []struct {
+		name    string
+		entries []string
+	}{
+		{"EXTRA_REPOSITORY_ROLES", config.ExtraRepositoryRoles},
+		{"EXTRA_PROJECT_ROLES", config.ExtraProjectRoles},
+		{"EXTRA_BUCKET_ROLES", config.ExtraBucketRoles},
+	}
+
+	for _, setting := range settings {
+		roles, err := parseExtraRoles(setting.entries)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", setting.name, err)
+		}
+
+		for _, role := range roles {
+			// Trust profiles list the roles of each kind of workflow themselves
+			if role.member == "" && len(config.TrustProfiles) > 0 {
+				return fmt.Errorf("invalid %s: role %s needs a member with TRUST_PROFILES, list it in the trust profiles instead", setting.name, role.role)
+			}
+		}
+	}
+
+	return nil
+}
+
+// extraBindingKey returns the binding name suffix of an extra role granted to a principal or its member override.
+// Bindings are named after the role and the member, never the position, so reordering the roles changes nothing.
+func (e extraRole) extraBindingKey(principal pipelinePrincipal) string {
+	switch {
+	case e.member != "":
+		return "extra-" + memberKey(e.member)
+	case principal.key != "":
+		return "extra-" + principal.key
+	default:
+		return "extra"
+	}
+}
+
+// memberOutput returns the member override as an output
+func (e extraRole) memberOutput() pulumi.StringOutput {
+	return pulumi.String(e.member).ToStringOutput()
+}
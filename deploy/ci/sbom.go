@@ -0,0 +1,136 @@
+package ci
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Project roles granted to the pipeline for SBOM uploads
+const (
+	// Container Analysis notes and occurrences editor and bucket viewer predefined roles
+	SBOMRoleLegacy = "legacy"
+	// A custom role with only the permissions gcloud artifacts sbom load needs
+	SBOMRoleCustom = "custom"
+	// Both, so workflows keep working while the custom role propagates. Switch to custom afterwards.
+	SBOMRoleBoth = "both"
+)
+
+// sbomCustomRoleKey tells apart the custom role bindings from the predefined role ones
+const sbomCustomRoleKey = "sbom-publisher"
+
+// legacySBOMRoles are the predefined roles granting SBOM uploads, along with edits to every note and occurrence
+// See: https://cloud.google.com/artifact-analysis/docs/generate-store-sboms
+var legacySBOMRoles = []string{
+	"roles/containeranalysis.notes.editor",
+	"roles/containeranalysis.occurrences.editor",
+	sbomBucketViewerRole,
+}
+
+// sbomPublisherPermissions are the permissions gcloud artifacts sbom load needs, besides writing the SBOM to the
+// bucket: find the bucket, then create or reuse the SBOM note and attach a reference occurrence to the image.
+// Notes and occurrences can't be updated or deleted.
+var sbomPublisherPermissions = []string{
+	"containeranalysis.notes.attachOccurrence",
+	"containeranalysis.notes.create",
+	"containeranalysis.notes.get",
+	"containeranalysis.notes.list",
+	"containeranalysis.occurrences.create",
+	"containeranalysis.occurrences.get",
+	"containeranalysis.occurrences.list",
+	"storage.buckets.get",
+}
+
+// lookupSBOMRole normalizes an SBOM role mode. Empty defaults to legacy.
+func lookupSBOMRole(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "", SBOMRoleLegacy:
+		return SBOMRoleLegacy, nil
+	case SBOMRoleCustom:
+		return SBOMRoleCustom, nil
+	case SBOMRoleBoth:
+		return SBOMRoleBoth, nil
+	default:
+		return "", fmt.Errorf("unknown SBOM role mode %q, must be one of: %s, %s, %s", mode, SBOMRoleLegacy, SBOMRoleCustom, SBOMRoleBoth)
+	}
+}
+
+// sbomBucketViewerRole lets gcloud artifacts sbom load find the SBOM bucket
+const sbomBucketViewerRole = "roles/storage.bucketViewer"
+
+// projectRole is a project-level role of the pipeline
+type projectRole struct {
+	// Stable suffix of the binding name. The role itself for predefined roles, since custom role names are only known once created.
+	key  string
+	role pulumi.StringInput
+	// Project the role is granted on
+	project string
+}
+
+// predefinedProjectRoles turns role names into project roles on a project
+func predefinedProjectRoles(roles []string, project string) []projectRole {
+	projectRoles := make([]projectRole, 0, len(roles))
+	for _, role := range roles {
+		projectRoles = append(projectRoles, projectRole{key: role, role: pulumi.String(role), project: project})
+	}
+
+	return projectRoles
+}
+
+// pipelineProjectRoles returns the project roles of the pipeline for the SBOM role mode. Container Analysis
+// roles are granted on the registry project, where the images are, and the bucket viewer role on the bucket project.
+func (r *GithubGoogleRegistry) pipelineProjectRoles() []projectRole {
+	var roles []projectRole
+
+	if r.config.SBOMRole != SBOMRoleCustom {
+		for _, role := range predefinedProjectRoles(legacySBOMRoles, r.config.registryProject()) {
+			if role.key == sbomBucketViewerRole {
+				role.project = r.config.sbomBucketProject()
+			}
+
+			roles = append(roles, role)
+		}
+	}
+
+	if r.config.SBOMRole != SBOMRoleLegacy {
+		roles = append(roles, projectRole{key: sbomCustomRoleKey, role: r.SBOMCustomRole.Name, project: r.config.registryProject()})
+
+		// Project custom roles can only be granted on their own project, the bucket of another project needs the viewer role
+		if r.config.SBOMRole == SBOMRoleCustom && r.config.sbomBucketProject() != r.config.registryProject() {
+			roles = append(roles, predefinedProjectRoles([]string{sbomBucketViewerRole}, r.config.sbomBucketProject())...)
+		}
+	}
+
+	return roles
+}
+
+// newSBOMCustomRole creates the custom role granting SBOM uploads. It's created in every mode, and only bound
+// without the legacy roles: GCP soft-deletes custom roles and blocks their ID for 37 days, so a role deleted when
+// switching to legacy could not be created again when switching back.
+func (r *GithubGoogleRegistry) newSBOMCustomRole(ctx *pulumi.Context) error {
+	// Custom role IDs only allow letters, digits, underscores and periods
+	roleID := fmt.Sprintf("%s_sbom_publisher", strings.ReplaceAll(r.config.ResourcePrefix, "-", "_"))
+
+	role, err := projects.NewIAMCustomRole(ctx, fmt.Sprintf("%s-%s-role", r.config.ResourcePrefix, sbomCustomRoleKey), &projects.IAMCustomRoleArgs{
+		Project:     pulumi.String(r.config.registryProject()),
+		RoleId:      pulumi.String(roleID),
+		Title:       pulumi.String("SBOM Publisher"),
+		Description: pulumi.String("Upload SBOMs and reference them from Container Analysis, without editing other notes and occurrences"),
+		Permissions: pulumi.ToStringArray(sbomPublisherPermissions),
+		Stage:       pulumi.String("GA"),
+	},
+		pulumi.Parent(r),
+		pulumi.Protect(r.config.ProtectResources),
+		// Dropping the role from the stack must not block its ID
+		pulumi.RetainOnDelete(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create SBOM custom role: %w", err)
+	}
+
+	r.SBOMCustomRole = role
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package ci
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// Automatic vulnerability scanning modes for a repository
+const (
+	// Scan pushed artifacts, enabling the Container Scanning API in the project
+	VulnerabilityScanningEnabled = "enabled"
+	// Never scan the repository, even when the project has scanning on
+	VulnerabilityScanningDisabled = "disabled"
+	// Scan only if the Container Scanning API is already enabled in the project
+	VulnerabilityScanningInherited = "inherited"
+)
+
+// lookupVulnerabilityScanning normalizes a scanning mode. Empty defaults to inherited.
+func lookupVulnerabilityScanning(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "", VulnerabilityScanningInherited:
+		return VulnerabilityScanningInherited, nil
+	case VulnerabilityScanningEnabled:
+		return VulnerabilityScanningEnabled, nil
+	case VulnerabilityScanningDisabled:
+		return VulnerabilityScanningDisabled, nil
+	default:
+		return "", fmt.Errorf("unknown vulnerability scanning mode %q, must be one of: %s, %s, %s",
+			mode, VulnerabilityScanningEnabled, VulnerabilityScanningDisabled, VulnerabilityScanningInherited)
+	}
+}
+
+// newVulnerabilityScanningConfig returns the repository scanning settings for a mode. The repository only
+// knows whether it opts out: enabling scanning is done at the project level through the API.
+func newVulnerabilityScanningConfig(mode string) *artifactregistry.RepositoryVulnerabilityScanningConfigArgs {
+	enablementConfig := "INHERITED"
+	if mode == VulnerabilityScanningDisabled {
+		enablementConfig = "DISABLED"
+	}
+
+	return &artifactregistry.RepositoryVulnerabilityScanningConfigArgs{
+		EnablementConfig: pulumi.String(enablementConfig),
+	}
+}
+
+// enableVulnerabilityScanning enables the Container Scanning API when any repository has scanning enabled.
+// It returns nil when scanning is left to the project settings.
+func (r *GithubGoogleRegistry) enableVulnerabilityScanning(ctx *pulumi.Context, repositories []*managedRepository) (*projects.Service, error) {
+	enabled := r.config.VulnerabilityScanning == VulnerabilityScanningEnabled
+
+	for _, repository := range repositories {
+		enabled = enabled || repository.vulnerabilityScanning == VulnerabilityScanningEnabled
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	scanningAPI, err := r.enableRegistryAPI(ctx, "containerscanning", "containerscanning.googleapis.com")
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable Container Scanning API: %w", err)
+	}
+
+	return scanningAPI, nil
+}
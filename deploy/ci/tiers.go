@@ -0,0 +1,99 @@
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var environmentTierPattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,14}$`)
+
+// resolveEnvironmentTiers returns a repository per environment tier, lowest tier first.
+// Every trusted workflow can push to the lowest tier, while the upper tiers only accept
+// images from the promotion workflow, which can read the tier right below to copy from it.
+func resolveEnvironmentTiers(config *Config, seen map[string]bool) ([]*managedRepository, error) {
+	if len(config.EnvironmentTiers) == 0 {
+		return nil, nil
+	}
+
+	if len(config.EnvironmentTiers) < 2 {
+		return nil, fmt.Errorf("at least two environment tiers are required to promote images, got %v", config.EnvironmentTiers)
+	}
+
+	if config.PromotionWorkflow == "" || config.PromotionRef == "" {
+		return nil, fmt.Errorf("PROMOTION_WORKFLOW and PROMOTION_REF are required with environment tiers")
+	}
+
+	format, err := lookupRepositoryFormat(config.RepositoryFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	cleanupPolicies, err := normalizeCleanupPolicies(config.CleanupPolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ImmutableTags && format.name == FormatDocker {
+		err = validateImmutableCleanupPolicies(cleanupPolicies)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tiers := make([]*managedRepository, 0, len(config.EnvironmentTiers))
+
+	for i, tier := range config.EnvironmentTiers {
+		if !environmentTierPattern.MatchString(tier) {
+			return nil, fmt.Errorf("environment tier %q must be lowercase letters and digits", tier)
+		}
+
+		name := fmt.Sprintf("%s-%s", config.RepositoryName, tier)
+		if seen[name] {
+			return nil, fmt.Errorf("repository %q for environment tier %s is configured more than once", name, tier)
+		}
+
+		seen[name] = true
+
+		repository := &managedRepository{
+			name:                  name,
+			format:                format,
+			description:           fmt.Sprintf("%s for the %s environment", format.description, tier),
+			keepCount:             config.RecentImageRetentionCount,
+			olderThan:             config.OldImageDeletionDays,
+			immutableTags:         config.ImmutableTags && format.name == FormatDocker,
+			cleanupPolicies:       cleanupPolicies,
+			cleanupDryRun:         config.CleanupPolicyDryRun,
+			vulnerabilityScanning: config.VulnerabilityScanning,
+			tier:                  tier,
+			labels: map[string]string{
+				"purpose":     format.purpose,
+				"environment": tier,
+				"managed-by":  "pulumi",
+			},
+		}
+
+		if i == 0 {
+			repository.pipelineRole = "roles/artifactregistry.writer"
+			repository.promotionRole = "roles/artifactregistry.reader"
+		} else {
+			repository.promotionRole = "roles/artifactregistry.writer"
+		}
+
+		tiers = append(tiers, repository)
+	}
+
+	return tiers, nil
+}
+
+// promotionWorkflowRef returns the workflow_ref claim of the promotion workflow runs, e.g.
+// my-org/my-repo/.github/workflows/promote.yml@refs/heads/main
+func promotionWorkflowRef(config *Config, repoName string) string {
+	workflow := config.PromotionWorkflow
+	// Workflows are relative to the trusted repository unless qualified with their own
+	if strings.HasPrefix(workflow, ".github/") {
+		workflow = fmt.Sprintf("%s/%s", repoName, workflow)
+	}
+
+	return fmt.Sprintf("%s@%s", workflow, config.PromotionRef)
+}
@@ -0,0 +1,148 @@
+package ci
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/artifactregistry"
+	"github.com/pulumi/pulumi-gcp/sdk/v8/go/gcp/projects"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// virtualUpstreamPriorityStep separates the default priorities so upstreams can be slotted in between later
+const virtualUpstreamPriorityStep = 10
+
+// virtualUpstream is a repository served through the virtual repository
+type virtualUpstream struct {
+	id         string
+	repository *artifactregistry.Repository
+	priority   int
+}
+
+// resolveVirtualUpstreamPriorities returns the priority of each remote cache in the virtual repository
+// and the priority of the registry, which is always the highest so private images win over upstream ones.
+func resolveVirtualUpstreamPriorities(config *Config, caches []remoteCache) (map[string]int, int, error) {
+	known := map[string]bool{}
+	for _, cache := range caches {
+		known[cache.name] = true
+	}
+
+	for name, priority := range config.VirtualRepositoryPriorities {
+		if !known[name] {
+			return nil, 0, fmt.Errorf("priority configured for unknown remote cache %q", name)
+		}
+
+		if priority <= 0 {
+			return nil, 0, fmt.Errorf("priority for remote cache %q must be positive, got %d", name, priority)
+		}
+	}
+
+	priorities := make(map[string]int, len(caches))
+	taken := map[int]string{}
+	highest := 0
+
+	for i, cache := range caches {
+		// Unless configured, caches are preferred in the order they were declared
+		priority, ok := config.VirtualRepositoryPriorities[cache.name]
+		if !ok {
+			priority = (len(caches) - i) * virtualUpstreamPriorityStep
+		}
+
+		if other, clash := taken[priority]; clash {
+			return nil, 0, fmt.Errorf("remote caches %q and %q have the same priority %d", other, cache.name, priority)
+		}
+
+		taken[priority] = cache.name
+		priorities[cache.name] = priority
+		highest = max(highest, priority)
+	}
+
+	return priorities, highest + virtualUpstreamPriorityStep, nil
+}
+
+// deployVirtualRepository aggregates the primary repository and the remote caches behind a single pull URL
+func (r *GithubGoogleRegistry) deployVirtualRepository(ctx *pulumi.Context, primary *managedRepository, caches []remoteCache, principals []pipelinePrincipal, registryAPI *projects.Service) error {
+	if !r.config.VirtualRepository {
+		return nil
+	}
+
+	cachePriorities, registryPriority, err := resolveVirtualUpstreamPriorities(r.config, caches)
+	if err != nil {
+		return err
+	}
+
+	upstreams := make([]virtualUpstream, 0, len(caches)+1)
+	upstreams = append(upstreams, virtualUpstream{
+		id:         primary.name,
+		repository: primary.repository,
+		priority:   registryPriority,
+	})
+
+	// Remote cache repositories are created in the same order as the configured caches
+	for i, cache := range caches {
+		upstreams = append(upstreams, virtualUpstream{
+			id:         cache.name,
+			repository: r.RemoteCacheRepositories[i],
+			priority:   cachePriorities[cache.name],
+		})
+	}
+
+	upstreamPolicies := make(artifactregistry.RepositoryVirtualRepositoryConfigUpstreamPolicyArray, 0, len(upstreams))
+	dependencies := make([]pulumi.Resource, 0, len(upstreams)+1)
+	dependencies = append(dependencies, registryAPI)
+
+	for _, upstream := range upstreams {
+		upstreamPolicies = append(upstreamPolicies, &artifactregistry.RepositoryVirtualRepositoryConfigUpstreamPolicyArgs{
+			Id:         pulumi.String(upstream.id),
+			Repository: upstream.repository.ID().ToStringOutput(),
+			Priority:   pulumi.Int(upstream.priority),
+		})
+
+		dependencies = append(dependencies, upstream.repository)
+	}
+
+	dockerFormat := repositoryFormats[FormatDocker]
+
+	virtual, err := artifactregistry.NewRepository(ctx, r.NewResourceName(r.repositoryName, "virtual-repo", 63), &artifactregistry.RepositoryArgs{
+		RepositoryId: pulumi.String(r.NewResourceName(r.repositoryName, "virtual", 63)),
+		Location:     pulumi.String(r.config.RepositoryLocation),
+		Project:      pulumi.String(r.config.registryProject()),
+		Description:  pulumi.String("CI/CD Docker registry aggregating private images and upstream caches"),
+		Format:       pulumi.String(FormatDocker),
+		Mode:         pulumi.String("VIRTUAL_REPOSITORY"),
+		Labels: pulumi.StringMap{
+			"managed-by": pulumi.String("pulumi"),
+			"purpose":    pulumi.String("docker-virtual"),
+		},
+		VirtualRepositoryConfig: &artifactregistry.RepositoryVirtualRepositoryConfigArgs{
+			UpstreamPolicies: upstreamPolicies,
+		},
+	},
+		pulumi.Parent(r),
+		pulumi.Protect(r.config.ProtectResources),
+		pulumi.DependsOn(dependencies),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create virtual repository: %w", err)
+	}
+
+	// Artifact Registry only checks access on the virtual repository, which reads its upstreams on the callers' behalf
+	for _, principal := range pullPrincipals(principals) {
+		member, err := artifactregistry.NewRepositoryIamMember(ctx, principal.bindingName(fmt.Sprintf("%s-virtual-repo-iam-roles/artifactregistry.reader", r.config.ResourcePrefix)), &artifactregistry.RepositoryIamMemberArgs{
+			Repository: virtual.Name,
+			Location:   pulumi.String(r.config.RepositoryLocation),
+			Project:    pulumi.String(r.config.registryProject()),
+			Role:       pulumi.String("roles/artifactregistry.reader"),
+			Member:     principal.id,
+		}, pulumi.Parent(r))
+		if err != nil {
+			return fmt.Errorf("failed to create virtual repository IAM member: %w", err)
+		}
+
+		r.VirtualRepositoryIAMMembers = append(r.VirtualRepositoryIAMMembers, member)
+	}
+
+	r.VirtualRepository = virtual
+	r.VirtualRegistryURL = dockerFormat.endpoint(r.config.RepositoryLocation, r.config.registryProject(), virtual.RepositoryId)
+
+	return nil
+}
@@ -29,13 +29,61 @@ func main() {
 
 		// Export the outputs for use in CI/CD
 		ctx.Export("registryURL", ciInfra.RegistryURL)
+		ctx.Export("registryURLs", ciInfra.RegistryURLs)
+		ctx.Export("registryFormat", ciInfra.RegistryFormat)
+		ctx.Export("immutableTags", ciInfra.ImmutableTags)
+		ctx.Export("vulnerabilityScanningStates", ciInfra.VulnerabilityScanningStates)
 		ctx.Export("workloadIdentityPoolID", pulumi.ToSecret(ciInfra.WorkloadIdentityPool.ID()))
 		ctx.Export("workloadIdentityProviderID", pulumi.ToSecret(ciInfra.OidcProvider.ID()))
 		ctx.Export("workloadIdentityProviderCondition", ciInfra.OidcProvider.AttributeCondition)
+		ctx.Export("workloadIdentityProviderIDs", pulumi.ToSecret(ciInfra.WorkloadIdentityPoolProviderIDs))
+
+		if _, ok := ciInfra.OidcProviders[ci.ProviderGitHub]; ok {
+			ctx.Export("expectedAudience", ciInfra.ExpectedAudience)
+		}
 		ctx.Export("repositoryWorkloadID", ciInfra.RepositoryPrincipalID)
+		ctx.Export("repositoryWorkloadIDs", ciInfra.RepositoryPrincipalIDs)
+
+		if ciInfra.RepositoryWritePrincipalIDs != nil {
+			ctx.Export("repositoryWriteWorkloadIDs", ciInfra.RepositoryWritePrincipalIDs)
+		}
+
+		if ciInfra.TrustProfilePrincipalIDs != nil {
+			ctx.Export("trustProfileWorkloadIDs", ciInfra.TrustProfilePrincipalIDs)
+		}
 		ctx.Export("sbomBucketName", ciInfra.SBOMBucket.Name)
 
-		if config.CreateServiceAccount {
+		ctx.Export("sbomCustomRoleName", ciInfra.SBOMCustomRole.Name)
+
+		if len(ciInfra.ReaderMembers) > 0 {
+			ctx.Export("readerMembers", pulumi.ToStringArray(ciInfra.ReaderMembers))
+		}
+
+		if len(ciInfra.RemoteCacheURLs) > 0 {
+			ctx.Export("remoteCacheURLs", ciInfra.RemoteCacheURLs)
+		}
+
+		if len(config.EnvironmentTiers) > 0 {
+			ctx.Export("environmentRegistryURLs", ciInfra.EnvironmentRegistryURLs)
+			ctx.Export("promotionWorkloadID", ciInfra.PromotionPrincipalID)
+		}
+
+		if config.VirtualRepository {
+			ctx.Export("virtualRegistryURL", ciInfra.VirtualRegistryURL)
+		}
+
+		if config.CreateKMSKey || config.KMSKeyName != "" {
+			ctx.Export("repositoryKMSKeyName", ciInfra.RepositoryKMSKeyName)
+		}
+
+		if config.CreateKMSKey || config.KMSKeyName != "" || config.SBOMBucketKMSKeyName != "" {
+			ctx.Export("sbomBucketKMSKeyName", ciInfra.SBOMBucketKMSKeyName)
+		}
+
+		// google-github-actions/auth takes the service account as well in the service-account and both modes
+		ctx.Export("authMode", pulumi.String(ciInfra.AuthMode))
+
+		if ciInfra.GitHubActionsServiceAccount != nil {
 			ctx.Export("serviceAccountEmail", pulumi.ToSecret(ciInfra.GitHubActionsServiceAccount.Email))
 		}
 